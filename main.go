@@ -1,52 +1,113 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/antonsoroko/statsd-router/statsdrouter"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var (
-	configFile       = flag.String("config", "statsd-router.json", "Configuration file path")
-	bindAddress      = flag.String("bind-address", "0.0.0.0", "Address to bind")
-	port             = flag.Uint("port", 48125, "Port to use")
-	apiPort          = flag.Uint("api-port", 48126, "Port for API to use")
-	masterHostString = flag.String("master-statsd-host", "localhost:8125:8126", "Host that will receive all metrics. Format is host:port:mgmt_port")
-	checkInterval    = flag.Int64("check-interval", 180, "Interval of checking for backend health")
-	debug            = flag.Bool("debug", false, "Enable debug mode")
-	printStats       = flag.Bool("print-stats", false, "Enable printing internal statistics to the console")
+	configFile        = flag.String("config", "statsd-router.json", "Configuration file path")
+	bindAddress       = flag.String("bind-address", "0.0.0.0", "Address to bind")
+	port              = flag.Uint("port", 48125, "Port to use")
+	apiPort           = flag.Uint("api-port", 48126, "Port for API to use")
+	masterHostString  = flag.String("master-statsd-host", "localhost:8125:8126", "Host that will receive all metrics. Format is host:port:mgmt_port")
+	checkInterval     = flag.Int64("check-interval", statsdrouter.DefaultCheckInterval, "Interval of checking for backend health")
+	unhealthyInterval = flag.Int64("unhealthy-check-interval", 10, "Interval of checking for backend health while it is down or its state is changing")
+	resolveInterval   = flag.Int64("resolve-interval", 60, "Interval of re-resolving backend hostnames in seconds, 0 disables it")
+	dnsServer         = flag.String("dns-server", "", "DNS server (host:port) for backend discovery, system resolver by default")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 10*time.Second, "Max time of draining and flushing metrics on shutdown")
+	healthRise        = flag.Int("health-rise", statsdrouter.DefaultHealthCheckRise, "Number of consecutive successful health checks to mark backend up")
+	healthFall        = flag.Int("health-fall", statsdrouter.DefaultHealthCheckFall, "Number of consecutive failed health checks to mark backend down")
+	overflowPolicy    = flag.String("overflow-policy", "block", "What to do with metrics when backend queue is full: block, drop-newest or drop-oldest (can be overridden per node in config)")
+	debug             = flag.Bool("debug", false, "Enable debug mode (same as -log-level debug)")
+	logLevel          = flag.String("log-level", "info", "Log level of all components: debug, info, warn or error")
+	logFormat         = flag.String("log-format", "logfmt", "Log format: logfmt or json")
+	packetChannel     = flag.Int("packet-channel-size", 0, "Size of the channel of received packets (default 256 * GOMAXPROCS)")
+	metricChannel     = flag.Int("metric-channel-size", 0, "Size of the channel of parsed metrics (default 1024 * GOMAXPROCS)")
+	packetHandlers    = flag.Int("packet-handlers", 0, "Number of packet handler goroutines (default GOMAXPROCS)")
+	metricHandlers    = flag.Int("metric-handlers", 0, "Number of metric handler goroutines (default GOMAXPROCS)")
+	queueSize         = flag.Int("queue-size", 0, "Size of the send queue of every backend, can be overridden per node in config (default 1024)")
+	senders           = flag.Int("senders", 0, "Number of sender goroutines of every backend (default GOMAXPROCS, max 4)")
+	printStats        = flag.Bool("print-stats", false, "Enable printing internal statistics to the console")
+	metricsPrefix     = flag.String("internal-metrics-prefix", "statsd-router", "Prefix of internal metrics sent to StatsD")
+	metricsInterval   = flag.Int64("internal-metrics-interval", 0, "Interval of sending internal metrics to StatsD in seconds, 0 disables sending")
+	metricsBackend    = flag.String("internal-metrics-backend", "", "Backend that will receive internal metrics. Format is host:port:mgmt_port, master host is used if empty")
 )
 
 func main() {
 	flag.Parse()
-	masterHost, err := statsdrouter.NewStatsdNode(*masterHostString)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		slog.Error("Failed to parse log-level", "error", err)
+		os.Exit(1)
+	}
+	if *debug {
+		level = slog.LevelDebug
+	}
+	logging, err := statsdrouter.NewLogging(os.Stderr, *logFormat, level)
 	if err != nil {
-		log.Fatalf("Failed to convert master-statsd-host to StatsdNode: %s", err)
+		slog.Error("Failed to set up logging", "error", err)
+		os.Exit(1)
 	}
-	log.Printf("Using %+v as master host", masterHost)
-	statsdrouter.DebugMode = *debug
-	statsdrouter.PrintStats = *printStats
+	logger := logging.Logger(statsdrouter.ComponentRouter)
 
-	quit := make(chan bool)
+	masterHost, err := statsdrouter.NewStatsdNode(*masterHostString)
+	if err != nil {
+		logger.Error("Failed to convert master-statsd-host to StatsdNode", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Using master host", "host", masterHost.Host, "port", masterHost.Port, "mgmt_port", masterHost.ManagementPort)
 
-	handleSignals(quit)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel, logger)
 
-	statsdrouter.StartRouter(
-		*bindAddress,
-		uint16(*port),
-		uint16(*apiPort),
-		masterHost,
-		*configFile,
-		*checkInterval,
-		quit,
-	)
-	log.Println("Exit.")
+	err = statsdrouter.StartRouter(ctx, statsdrouter.RouterOptions{
+		BindAddress: *bindAddress,
+		Port:        uint16(*port),
+		APIPort:     uint16(*apiPort),
+		MasterHost:  masterHost,
+		ConfigPath:  *configFile,
+		Pipeline: statsdrouter.PipelineConfig{
+			PacketChannelSize: *packetChannel,
+			MetricChannelSize: *metricChannel,
+			PacketHandlers:    *packetHandlers,
+			MetricHandlers:    *metricHandlers,
+			QueueSize:         *queueSize,
+			Senders:           *senders,
+		},
+		Backend: statsdrouter.BackendOptions{
+			CheckInterval:          *checkInterval,
+			UnhealthyCheckInterval: *unhealthyInterval,
+			Rise:                   *healthRise,
+			Fall:                   *healthFall,
+			OverflowPolicy:         *overflowPolicy,
+			ResolveInterval:        *resolveInterval,
+			DNSServer:              *dnsServer,
+		},
+		InternalMetrics: statsdrouter.InternalMetricsConfig{
+			Prefix:   *metricsPrefix,
+			Interval: *metricsInterval,
+			Backend:  *metricsBackend,
+		},
+		ShutdownTimeout: *shutdownTimeout,
+		PrintStats:      *printStats,
+		Logging:         logging,
+	})
+	if err != nil {
+		logger.Error("Router failed", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Exit.")
 }
 
-func handleSignals(quit chan bool) {
+func handleSignals(cancel context.CancelFunc, logger *slog.Logger) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func(chan os.Signal) {
@@ -54,17 +115,17 @@ func handleSignals(quit chan bool) {
 		defer signal.Stop(sigs)
 	loop:
 		for sig := range sigs {
-			log.Printf("caught signal: %+v", sig)
+			logger.Info("Caught signal", "signal", sig)
 			switch sig {
 			case os.Interrupt, syscall.SIGTERM:
-				log.Println("Sending quit signal to goroutines...")
-				close(quit)
+				logger.Info("Sending quit signal to goroutines...")
+				cancel()
 				break loop
 			case syscall.SIGHUP:
 				// TODO: implement real reloading?
-				log.Println("Reloading...")
+				logger.Info("Reloading...")
 			}
-			log.Println("Terminating Signals Handler.")
+			logger.Info("Terminating Signals Handler.")
 		}
 	}(sigs)
 }
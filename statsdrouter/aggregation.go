@@ -0,0 +1,312 @@
+// Local pre-aggregation of metrics before they are sent to backends
+package statsdrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default aggregation settings
+const (
+	// seconds
+	DefaultAggregationFlushInterval = 10
+	DefaultAggregationTimerSamples  = 1000
+)
+
+// Max size of a packet with aggregated metrics
+const aggregatedPacketSize = 1400
+
+// Aggregation settings of a rule or the master backend
+type AggregationConfig struct {
+	// Flush window in seconds, 10 by default
+	FlushInterval int64 `json:"flush_interval,omitempty"`
+	// Max number of timer samples kept per name and window, 1000 by default;
+	// above it samples are picked at random and their sample rate is scaled accordingly
+	MaxTimerSamples int `json:"max_timer_samples,omitempty"`
+}
+
+// Aggregations of rules and the master backend
+type AggregationsConfig struct {
+	Master *AggregationConfig           `json:"master,omitempty"`
+	Rules  map[string]AggregationConfig `json:"rules,omitempty"`
+}
+
+// Checks settings and fills defaults
+// returns settings and an error
+func (config AggregationConfig) normalize() (AggregationConfig, error) {
+	if config.FlushInterval < 0 || config.MaxTimerSamples < 0 {
+		return config, errors.New("flush_interval and max_timer_samples can't be negative")
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultAggregationFlushInterval
+	}
+	if config.MaxTimerSamples == 0 {
+		config.MaxTimerSamples = DefaultAggregationTimerSamples
+	}
+	return config, nil
+}
+
+// Timer sample with its sample rate
+type timerSample struct {
+	value float64
+	rate  float64
+}
+
+// Aggregated values of one name, type and tags
+type aggregate struct {
+	name       string
+	metricType string
+	tags       []string
+	// counter sum or gauge value
+	value float64
+	// gauge was set to an absolute value, otherwise value is a sum of relative changes
+	absolute bool
+	set      map[string]struct{}
+	samples  []timerSample
+	// number of timer lines, samples holds a random subset of them
+	timerLines int
+}
+
+// Aggregates metrics of one rule or the master backend over a flush window
+type Aggregator struct {
+	Config AggregationConfig
+	Stats  struct {
+		// Lines added to the aggregator
+		Received atomic.Uint64
+		// Lines sent at flush time
+		Flushed atomic.Uint64
+	}
+	lock       sync.Mutex
+	aggregates map[string]*aggregate
+	nextFlush  time.Time
+}
+
+// Creates a new Aggregator struct
+// accepts aggregation settings as parameter
+// returns the *Aggregator struct and an error
+func NewAggregator(config AggregationConfig) (*Aggregator, error) {
+	config, err := config.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return &Aggregator{
+		Config:     config,
+		aggregates: make(map[string]*aggregate),
+		nextFlush:  time.Now().Add(time.Duration(config.FlushInterval) * time.Second),
+	}, nil
+}
+
+// Adds a metric to the current window
+// counters are summed taking sample rate into account, gauges keep the last value
+// (or the sum of relative changes), sets keep unique values and timers keep samples
+func (aggregator *Aggregator) Add(metric *StatsDMetric) {
+	key := metric.metricType + ":" + metric.name
+	if len(metric.tags) > 0 {
+		key += "|#" + strings.Join(metric.tags, ",")
+	}
+	aggregator.Stats.Received.Add(1)
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	current := aggregator.aggregates[key]
+	if current == nil {
+		current = &aggregate{name: metric.name, metricType: metric.metricType, tags: metric.tags}
+		aggregator.aggregates[key] = current
+	}
+	switch metric.metricType {
+	case "c":
+		current.value += metric.value / metric.SampleRate()
+	case "g":
+		if strings.HasPrefix(metric.valueText, "+") || strings.HasPrefix(metric.valueText, "-") {
+			current.value += metric.value
+		} else {
+			current.value = metric.value
+			current.absolute = true
+		}
+	case "s":
+		if current.set == nil {
+			current.set = make(map[string]struct{})
+		}
+		current.set[metric.valueText] = struct{}{}
+	case "ms":
+		current.timerLines++
+		sample := timerSample{value: metric.value, rate: metric.SampleRate()}
+		if len(current.samples) < aggregator.Config.MaxTimerSamples {
+			current.samples = append(current.samples, sample)
+		} else if i := rand.IntN(current.timerLines); i < len(current.samples) {
+			current.samples[i] = sample
+		}
+	}
+}
+
+// Formats a float without exponent and trailing zeros
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Formats aggregated lines of the window
+func (current *aggregate) lines() []string {
+	suffix := "|" + current.metricType
+	if len(current.tags) > 0 {
+		suffix += "|#" + strings.Join(current.tags, ",")
+	}
+	switch current.metricType {
+	case "c":
+		return []string{current.name + ":" + formatValue(current.value) + suffix}
+	case "g":
+		switch {
+		case !current.absolute && current.value >= 0:
+			return []string{current.name + ":+" + formatValue(current.value) + suffix}
+		case !current.absolute || current.value >= 0:
+			return []string{current.name + ":" + formatValue(current.value) + suffix}
+		}
+		// negative values are relative changes in StatsD, so the gauge is reset first
+		return []string{current.name + ":0" + suffix, current.name + ":" + formatValue(current.value) + suffix}
+	case "s":
+		values := make([]string, 0, len(current.set))
+		for value := range current.set {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		lines := make([]string, 0, len(values))
+		for _, value := range values {
+			lines = append(lines, current.name+":"+value+suffix)
+		}
+		return lines
+	case "ms":
+		// every kept sample stands for timerLines/len(samples) received ones
+		scale := float64(len(current.samples)) / float64(current.timerLines)
+		lines := make([]string, 0, len(current.samples))
+		for _, sample := range current.samples {
+			line := current.name + ":" + formatValue(sample.value) + "|ms"
+			if rate := sample.rate * scale; rate < 1 {
+				line += "|@" + formatValue(rate)
+			}
+			if len(current.tags) > 0 {
+				line += "|#" + strings.Join(current.tags, ",")
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+	return nil
+}
+
+// Takes aggregates of the current window and starts a new one
+// returns packets with aggregated lines
+func (aggregator *Aggregator) flush() [][]byte {
+	aggregator.lock.Lock()
+	aggregates := aggregator.aggregates
+	aggregator.aggregates = make(map[string]*aggregate, len(aggregates))
+	aggregator.nextFlush = time.Now().Add(time.Duration(aggregator.Config.FlushInterval) * time.Second)
+	aggregator.lock.Unlock()
+
+	keys := make([]string, 0, len(aggregates))
+	for key := range aggregates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, aggregates[key].lines()...)
+	}
+	aggregator.Stats.Flushed.Add(uint64(len(lines)))
+	return packLines(lines, aggregatedPacketSize)
+}
+
+// Checks if the window is over
+func (aggregator *Aggregator) due(now time.Time) bool {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	return !now.Before(aggregator.nextFlush)
+}
+
+// Active aggregators
+type aggregations struct {
+	master *Aggregator
+	rules  map[string]*Aggregator
+}
+
+// Creates aggregators
+// accepts aggregation settings, nil means no aggregation
+// returns *aggregations and an error
+func newAggregations(config *AggregationsConfig) (*aggregations, error) {
+	result := &aggregations{rules: make(map[string]*Aggregator)}
+	if config == nil {
+		return result, nil
+	}
+	if config.Master != nil {
+		master, err := NewAggregator(*config.Master)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation of master: %w", err)
+		}
+		result.master = master
+	}
+	for rule, ruleConfig := range config.Rules {
+		aggregator, err := NewAggregator(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation of rule %q: %w", rule, err)
+		}
+		result.rules[rule] = aggregator
+	}
+	return result, nil
+}
+
+// Sends aggregated metrics of due aggregators every second until ctx is done
+// metrics aggregated after that are flushed by flushAggregations on shutdown
+func (router *Router) runAggregations(ctx context.Context) error {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			router.flushAggregations(router.aggregations.Load(), func(aggregator *Aggregator) bool {
+				return aggregator.due(now)
+			})
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Sends aggregated metrics of aggregators selected by the filter, nil filter selects all of them
+// metrics of a rule are sent to its current backends, metrics of the master to the master backend
+func (router *Router) flushAggregations(current *aggregations, filter func(*Aggregator) bool) {
+	if current.master != nil && (filter == nil || filter(current.master)) {
+		for _, packet := range current.master.flush() {
+			router.sendPacket(router.masterBackend, packet)
+		}
+	}
+	for rule, aggregator := range current.rules {
+		if filter != nil && !filter(aggregator) {
+			continue
+		}
+		packets := aggregator.flush()
+		if len(packets) == 0 {
+			continue
+		}
+		for _, backend := range router.routingMap.RuleBackends(rule) {
+			for _, packet := range packets {
+				router.sendPacket(backend, packet)
+			}
+		}
+	}
+}
+
+// Enqueues a packet to the backend if it is alive and active, otherwise spools or drops it
+func (router *Router) sendPacket(backend *StatsDBackend, packet []byte) {
+	if send, _ := backendDecision(backend); !send {
+		if !backend.SpoolMetric(packet) {
+			backend.Stats.Dropped.Add(1)
+		}
+		return
+	}
+	backend.Enqueue(packet)
+}
@@ -3,12 +3,22 @@
 package statsdrouter
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Time given to API requests to finish on shutdown
+const apiShutdownTimeout = 5 * time.Second
+
 // JSON Error struct
 type JsonError struct {
 	Code    int    `json:"code"`
@@ -16,17 +26,131 @@ type JsonError struct {
 	Message string `json:"message"`
 }
 
+// Routing decision for one backend
+type BackendRoute struct {
+	Backend string `json:"backend"`
+	Alive   bool   `json:"alive"`
+	Mode    string `json:"mode"`
+	Send    bool   `json:"send"`
+	Reason  string `json:"reason"`
+	// Metric is added to the aggregator and sent at flush time
+	Aggregated bool `json:"aggregated,omitempty"`
+}
+
+// Matched rule with routing decisions for its backends
+type RuleRoute struct {
+	Rule     string         `json:"rule"`
+	Backends []BackendRoute `json:"backends"`
+	// Lines the backends receive after the rate limit and processors of the rule
+	Metrics []string `json:"metrics,omitempty"`
+	// Why backends of the rule don't receive the metric
+	Dropped string   `json:"dropped,omitempty"`
+	Notes   []string `json:"notes,omitempty"`
+}
+
+// Explanation of how a single metric line is routed
+type MetricRoute struct {
+	Metric string `json:"metric"`
+	Name   string `json:"name,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Why the metric doesn't reach any backend
+	Dropped string `json:"dropped,omitempty"`
+	// Steps which changed the metric, e.g. sampling or renaming by limits
+	Notes      []string      `json:"notes,omitempty"`
+	Rules      []RuleRoute   `json:"rules"`
+	Master     *BackendRoute `json:"master,omitempty"`
+	Quarantine *BackendRoute `json:"quarantine,omitempty"`
+}
+
+// Status of one backend
+type BackendStatus struct {
+	Backend             string       `json:"backend"`
+	Type                string       `json:"type"`
+	Address             string       `json:"address"`
+	AddressChanges      uint64       `json:"address_changes"`
+	Master              bool         `json:"master"`
+	Alive               bool         `json:"alive"`
+	Mode                string       `json:"mode"`
+	LastCheckTime       int64        `json:"last_check_time"`
+	ConsecutiveFailures int64        `json:"consecutive_failures"`
+	Suspect             bool         `json:"suspect"`
+	QueueDepth          int          `json:"queue_depth"`
+	QueueCapacity       int          `json:"queue_capacity"`
+	OverflowPolicy      string       `json:"overflow_policy"`
+	QueueDrops          uint64       `json:"queue_drops"`
+	PacketsSent         uint64       `json:"packets_sent"`
+	BytesSent           uint64       `json:"bytes_sent"`
+	SendErrors          uint64       `json:"send_errors"`
+	PassiveFailures     uint64       `json:"passive_failures"`
+	Rejected            uint64       `json:"rejected"`
+	Spool               *SpoolStatus `json:"spool,omitempty"`
+	Rules               []string     `json:"rules"`
+}
+
+// Status of backend's spool
+type SpoolStatus struct {
+	Bytes    int64  `json:"bytes"`
+	Spooled  uint64 `json:"spooled"`
+	Replayed uint64 `json:"replayed"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// Rate limit settings and counters
+type RateLimitStatus struct {
+	Key string `json:"key"`
+	RateLimitConfig
+	Allowed uint64 `json:"allowed"`
+	Sampled uint64 `json:"sampled"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Cardinality limit settings and counters
+type CardinalityLimitStatus struct {
+	CardinalityLimitConfig
+	Rejected uint64 `json:"rejected"`
+}
+
+// Cardinality limits and their top groups
+type CardinalityStatus struct {
+	Limits    []CardinalityLimitStatus `json:"limits"`
+	TopGroups []CardinalityGroupStatus `json:"top_groups"`
+}
+
+// Request to change backend mode
+type BackendModeRequest struct {
+	Backend string `json:"backend"`
+	Mode    string `json:"mode"`
+}
+
 // HTTP API struct
 type HttpApi struct {
-	port       uint16
-	config     *RouterConfig
-	routingMap *RoutingMap
+	port          uint16
+	router        *Router
+	config        *RouterConfig
+	routingMap    *RoutingMap
+	masterBackend *StatsDBackend
+	taps          *Taps
+	stats         *RouterStats
+	pipeline      PipelineConfig
+	logging       *Logging
+	logger        *slog.Logger
 }
 
 // Creates and returns new HttpApi
-// accepts a port, *RouterConfig and *RoutingMap
-func NewHttpApi(port uint16, config *RouterConfig, routingMap *RoutingMap) *HttpApi {
-	return &HttpApi{port: port, config: config, routingMap: routingMap}
+// accepts a port and the *Router it works with
+func NewHttpApi(port uint16, router *Router) *HttpApi {
+	return &HttpApi{
+		port:          port,
+		router:        router,
+		config:        router.config,
+		routingMap:    router.routingMap,
+		masterBackend: router.masterBackend,
+		taps:          router.taps,
+		stats:         router.stats,
+		pipeline:      router.pipeline,
+		logging:       router.logging,
+		logger:        router.logging.Logger(ComponentApi),
+	}
 }
 
 // Endpoint to work with rules (list, add)
@@ -43,38 +167,361 @@ func (api *HttpApi) rules(w http.ResponseWriter, r *http.Request) {
 		var err error
 		newConfig, err := readConfigFile(r.Body)
 		if err != nil {
+			api.stats.ConfigReloadsFailed.Add(1)
+			api.logger.Warn("Failed to read incoming config", "error", err)
 			message, _ := json.Marshal(JsonError{Code: 500, Error: "failed to read incoming config", Message: err.Error()})
 			http.Error(w, string(message), 500)
 			return
 		}
-		err = api.routingMap.UpdateRoutingMap(newConfig)
+		err = api.router.UpdateRules(newConfig)
 		if err != nil {
-			message, _ := json.Marshal(JsonError{Code: 500, Error: "failed to update routing map", Message: err.Error()})
+			api.logger.Error("Failed to update rules", "error", err)
+			message, _ := json.Marshal(JsonError{Code: 500, Error: "failed to update rules", Message: err.Error()})
 			http.Error(w, string(message), 500)
 			return
 		}
-		err = api.config.UpdateConfig(newConfig)
+		json.NewEncoder(w).Encode(map[string]string{"message": "The config was successfully updated."})
+		return
+	default:
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+}
+
+// Endpoint to explain routing decisions
+// accepts metric lines via "metric" query parameters (GET) or request body (POST)
+// metrics go through the same steps as received ones in dry-run mode: rate limits, processors,
+// cardinality limits and aggregation are applied without changing any state
+func (api *HttpApi) route(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var packet []byte
+	switch r.Method {
+	case "GET":
+		packet = []byte(strings.Join(r.URL.Query()["metric"], "\n"))
+	case "POST":
+		defer r.Body.Close()
+		var err error
+		packet, err = ioutil.ReadAll(r.Body)
 		if err != nil {
-			message, _ := json.Marshal(JsonError{Code: 500, Error: "failed to update config", Message: err.Error()})
-			http.Error(w, string(message), 500)
+			message, _ := json.Marshal(JsonError{Code: 400, Error: "failed to read request body", Message: err.Error()})
+			http.Error(w, string(message), 400)
 			return
 		}
-		log.Println(api.config)
-		for k, v := range api.routingMap.Map {
-			log.Println(k, v.Regexp, v.Backends)
+	default:
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	trace := &routeTrace{routes: []MetricRoute{}}
+	for _, metric := range parsePacket(packet) {
+		if metric.err != nil {
+			trace.routes = append(trace.routes, MetricRoute{Metric: string(metric.raw), Error: metric.err.Error(), Rules: []RuleRoute{}})
+			continue
 		}
-		json.NewEncoder(w).Encode(map[string]string{"message": "The config was successfully updated."})
+		api.router.routeMetric(metric, trace)
+	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(map[string][]MetricRoute{"metrics": trace.routes})
+}
+
+// Endpoint to list backends and their status
+func (api *HttpApi) backends(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	statuses := []BackendStatus{api.backendStatus(api.masterBackend, true)}
+	for _, backend := range api.routingMap.Backends() {
+		statuses = append(statuses, api.backendStatus(backend, false))
+	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(map[string][]BackendStatus{"backends": statuses})
+}
+
+// Endpoint to switch backend to active, drain or maintenance mode
+func (api *HttpApi) backendMode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	defer r.Body.Close()
+	var request BackendModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		message, _ := json.Marshal(JsonError{Code: 400, Error: "failed to read incoming request", Message: err.Error()})
+		http.Error(w, string(message), 400)
+		return
+	}
+	backend := api.router.Backend(request.Backend)
+	if backend == nil {
+		message, _ := json.Marshal(JsonError{Code: 404, Error: "backend not found", Message: request.Backend})
+		http.Error(w, string(message), 404)
+		return
+	}
+	if err := checkBackendMode(request.Mode); err != nil {
+		message, _ := json.Marshal(JsonError{Code: 400, Error: "failed to set backend mode", Message: err.Error()})
+		http.Error(w, string(message), 400)
+		return
+	}
+	// the mode is persisted first, so a failed save doesn't leave a live mode which is lost on restart
+	if err := api.config.SetBackendMode(request.Backend, request.Mode); err != nil {
+		api.logger.Error("Failed to update config", "error", err)
+		message, _ := json.Marshal(JsonError{Code: 500, Error: "failed to update config", Message: err.Error()})
+		http.Error(w, string(message), 500)
+		return
+	}
+	backend.SetMode(request.Mode)
+	json.NewEncoder(w).Encode(map[string]string{"message": "The backend mode was successfully updated."})
+}
+
+// Collects BackendStatus of a backend
+func (api *HttpApi) backendStatus(backend *StatsDBackend, master bool) BackendStatus {
+	health := backend.Status()
+	rules := []string{}
+	if !master {
+		rules = api.routingMap.RulesForBackend(backend)
+	}
+	var spoolStatus *SpoolStatus
+	if spool := backend.Spool(); spool != nil {
+		spoolStatus = &SpoolStatus{
+			Bytes:    spool.Size.Load(),
+			Spooled:  spool.Spooled.Load(),
+			Replayed: spool.Replayed.Load(),
+			Dropped:  spool.Dropped.Load(),
+		}
+	}
+	return BackendStatus{
+		Backend:             backend.Key(),
+		Type:                backend.Type,
+		Address:             backend.Address(),
+		AddressChanges:      backend.Stats.AddressChanges.Load(),
+		Master:              master,
+		Alive:               health.Alive,
+		Mode:                backend.Mode(),
+		LastCheckTime:       health.LastPingTime,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+		Suspect:             health.Suspect,
+		QueueDepth:          len(backend.SendChannel),
+		QueueCapacity:       cap(backend.SendChannel),
+		OverflowPolicy:      backend.OverflowPolicy(),
+		QueueDrops:          backend.Stats.QueueDrops.Load(),
+		PacketsSent:         backend.Stats.PacketsSent.Load(),
+		BytesSent:           backend.Stats.BytesSent.Load(),
+		SendErrors:          backend.Stats.SendErrors.Load(),
+		PassiveFailures:     backend.Stats.PassiveFailures.Load(),
+		Rejected:            backend.Stats.Rejected.Load(),
+		Spool:               spoolStatus,
+		Rules:               rules,
+	}
+}
+
+// Endpoint to stream metrics passing through the router as server-sent events
+// accepts optional "name" (regexp), "source", "backend", "sample" and "rate" query parameters
+func (api *HttpApi) tap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		message, _ := json.Marshal(JsonError{Code: 500, Error: "streaming is not supported"})
+		http.Error(w, string(message), 500)
+		return
+	}
+	query := r.URL.Query()
+	filter := TapFilter{Source: query.Get("source"), Backend: query.Get("backend")}
+	var err error
+	if name := query.Get("name"); name != "" {
+		filter.Name, err = regexp.Compile(name)
+	}
+	if err == nil && query.Get("sample") != "" {
+		filter.SampleRate, err = strconv.ParseFloat(query.Get("sample"), 64)
+	}
+	if err == nil && query.Get("rate") != "" {
+		filter.MaxEventsPerSecond, err = strconv.ParseInt(query.Get("rate"), 10, 64)
+	}
+	if err != nil {
+		message, _ := json.Marshal(JsonError{Code: 400, Error: "invalid tap parameters", Message: err.Error()})
+		http.Error(w, string(message), 400)
+		return
+	}
+	tap, err := api.taps.Subscribe(filter)
+	if err != nil {
+		message, _ := json.Marshal(JsonError{Code: 503, Error: "failed to create tap", Message: err.Error()})
+		http.Error(w, string(message), 503)
+		return
+	}
+	defer api.taps.Unsubscribe(tap)
+	api.logger.Info("Tap started", "remote", r.RemoteAddr, "query", r.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-tap.Events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": dropped %d\n\n", tap.Dropped.Load())
+			flusher.Flush()
+		case <-r.Context().Done():
+			api.logger.Info("Tap stopped", "remote", r.RemoteAddr, "dropped", tap.Dropped.Load())
+			return
+		}
+	}
+}
+
+// Endpoint to list rate limits and their counters
+func (api *HttpApi) rateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	statuses := []RateLimitStatus{}
+	for _, limiter := range api.router.RateLimiters() {
+		statuses = append(statuses, RateLimitStatus{
+			Key:             limiter.Config.Key(),
+			RateLimitConfig: limiter.Config,
+			Allowed:         limiter.Stats.Allowed.Load(),
+			Sampled:         limiter.Stats.Sampled.Load(),
+			Dropped:         limiter.Stats.Dropped.Load(),
+		})
+	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(map[string][]RateLimitStatus{"rate_limits": statuses})
+}
+
+// Endpoint to list cardinality limits and groups with most distinct names
+// accepts optional "top" query parameter, number of groups to show (20 by default, 0 means all)
+func (api *HttpApi) cardinality(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
+		return
+	}
+	top := 20
+	if value := r.URL.Query().Get("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 0 {
+			message, _ := json.Marshal(JsonError{Code: 400, Error: "invalid top parameter", Message: value})
+			http.Error(w, string(message), 400)
+			return
+		}
+	}
+	status := CardinalityStatus{Limits: []CardinalityLimitStatus{}, TopGroups: api.router.TopCardinalityGroups(top)}
+	for _, limiter := range api.router.CardinalityLimiters() {
+		status.Limits = append(status.Limits, CardinalityLimitStatus{CardinalityLimitConfig: limiter.Config, Rejected: limiter.Stats.Rejected.Load()})
+	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(status)
+}
+
+// Endpoint to show effective pipeline settings
+func (api *HttpApi) pipelineSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
+		http.Error(w, string(message), 405)
 		return
+	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(map[string]PipelineConfig{"pipeline": api.pipeline})
+}
+
+// Endpoint to list and change log levels of components
+// accepts a JSON object with component names as keys and levels as values (POST)
+func (api *HttpApi) logLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		defer r.Body.Close()
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			message, _ := json.Marshal(JsonError{Code: 400, Error: "failed to read incoming request", Message: err.Error()})
+			http.Error(w, string(message), 400)
+			return
+		}
+		for component, levelName := range request {
+			var level slog.Level
+			err := level.UnmarshalText([]byte(levelName))
+			if err == nil {
+				err = api.logging.SetLevel(component, level)
+			}
+			if err != nil {
+				message, _ := json.Marshal(JsonError{Code: 400, Error: "failed to set log level", Message: err.Error()})
+				http.Error(w, string(message), 400)
+				return
+			}
+			api.logger.Info("Log level was changed", "log_component", component, "level", level)
+		}
 	default:
 		message, _ := json.Marshal(JsonError{Code: 405, Error: "method not allowed"})
 		http.Error(w, string(message), 405)
 		return
 	}
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	jsonEnc.Encode(map[string]map[string]string{"levels": api.logging.Levels()})
+}
+
+// Mounts API handlers on the mux
+// use http.StripPrefix to serve them under a path prefix
+func (api *HttpApi) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/rules", api.rules)
+	mux.HandleFunc("/route", api.route)
+	mux.HandleFunc("/backends", api.backends)
+	mux.HandleFunc("/backends/mode", api.backendMode)
+	mux.HandleFunc("/metrics", api.metrics)
+	mux.HandleFunc("/log-levels", api.logLevels)
+	mux.HandleFunc("/tap", api.tap)
+	mux.HandleFunc("/pipeline", api.pipelineSettings)
+	mux.HandleFunc("/rate-limits", api.rateLimits)
+	mux.HandleFunc("/cardinality", api.cardinality)
 }
 
-// Starts API's HTTP server
-func (api *HttpApi) Start() {
-	http.HandleFunc("/rules", api.rules)
-	log.Printf("Starting API on port %d", api.port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", api.port), nil))
+// Runs API's HTTP server until ctx is done
+// returns an error if the server fails
+func (api *HttpApi) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	api.RegisterHandlers(mux)
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", api.port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	api.logger.Info("Starting API", "port", api.port)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	api.logger.Info("Stopping API")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package statsdrouter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serves the API of the router
+func newTestAPIServer(t *testing.T, router *Router) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	router.RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func postJSON(t *testing.T, url string, body string) int {
+	t.Helper()
+	response, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestBackendModeIsAppliedOnlyAfterItIsSaved(t *testing.T) {
+	node := StatsdNode{Host: "127.0.0.1", Port: 18210, ManagementPort: 18211}
+	config := &RouterConfig{
+		Rules:    map[string][]StatsdNode{`^app\.`: {node}},
+		FilePath: filepath.Join(t.TempDir(), "missing", "config.json"),
+	}
+	router := newTestRouter(t, config)
+	server := newTestAPIServer(t, router)
+	backend := router.Backend(node.Key())
+	request := `{"backend": "` + node.Key() + `", "mode": "drain"}`
+
+	if status := postJSON(t, server.URL+"/backends/mode", request); status != http.StatusInternalServerError {
+		t.Fatalf("got status %d with unwritable config file, want 500", status)
+	}
+	if mode := backend.Mode(); mode != BackendModeActive {
+		t.Fatalf("backend mode changed to %q although it was not saved", mode)
+	}
+	if mode := config.BackendMode(node.Key()); mode != "" {
+		t.Fatalf("config keeps mode %q which was not saved", mode)
+	}
+
+	config.lock.Lock()
+	config.FilePath = filepath.Join(t.TempDir(), "config.json")
+	config.lock.Unlock()
+	if status := postJSON(t, server.URL+"/backends/mode", request); status != http.StatusOK {
+		t.Fatalf("got status %d, want 200", status)
+	}
+	if mode := backend.Mode(); mode != BackendModeDrain {
+		t.Fatalf("backend mode is %q, want drain", mode)
+	}
+	data, err := os.ReadFile(config.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"`+node.Key()+`": "drain"`) {
+		t.Fatalf("mode is not saved in config file:\n%s", data)
+	}
+
+	if status := postJSON(t, server.URL+"/backends/mode", `{"backend": "`+node.Key()+`", "mode": "sleep"}`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for unknown mode, want 400", status)
+	}
+}
@@ -2,246 +2,862 @@
 package statsdrouter
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
 	"net"
-	"os"
-	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
+// Backend modes
+const (
+	// backend receives metrics while it is alive
+	BackendModeActive = "active"
+	// backend doesn't receive new metrics, already queued ones are still sent
+	BackendModeDrain = "drain"
+	// backend is treated as down regardless of health checks
+	BackendModeMaintenance = "maintenance"
+)
+
+// Policies of handling metrics when backend queue is full
+const (
+	// wait until there is free space in the queue
+	OverflowPolicyBlock = "block"
+	// drop the metric which doesn't fit into the queue
+	OverflowPolicyDropNewest = "drop-newest"
+	// drop the oldest queued metric to free space for the new one
+	OverflowPolicyDropOldest = "drop-oldest"
+)
+
+// Backend types
+const (
+	// StatsD protocol over UDP
+	BackendTypeStatsd = "statsd"
+	// Graphite plaintext protocol over TCP
+	BackendTypeGraphite = "graphite"
+	// InfluxDB line protocol over UDP or HTTP
+	BackendTypeInflux = "influxdb"
+)
+
+// Default interval of health checks in seconds
+const DefaultCheckInterval = 180
+
+// Retries of a failed batch write, the delay doubles after every attempt
+// a batch which still fails is spooled or dropped, so a dead backend doesn't stop its senders
+const (
+	maxBatchWriteAttempts = 4
+	minBatchRetryDelay    = 100 * time.Millisecond
+)
+
+// Writer of a backend which doesn't speak StatsD
+// it converts metrics to the backend's protocol and writes them in batches,
+// every sender goroutine has its own writer
+type batchWriter interface {
+	// Appends the metric in the backend's protocol to the buffer
+	// returns the buffer and false if the backend doesn't accept the metric
+	format(buffer []byte, metric *StatsDMetric, now time.Time) ([]byte, bool)
+	// Writes a batch, (re)connecting when needed
+	write(batch []byte) error
+	// Releases the connection
+	close()
+}
+
+// Settings shared by all backends, some of them can be overridden by StatsdNode
+type BackendOptions struct {
+	// Interval of health checks in seconds
+	CheckInterval int64
+	// Interval of health checks in seconds while backend is down or its state is changing
+	UnhealthyCheckInterval int64
+	// Number of consecutive successful checks to mark a down backend up
+	Rise int
+	// Number of consecutive failed checks to mark an up backend down
+	Fall int
+	// Interval of re-resolving backend hostname in seconds, 0 disables re-resolving
+	ResolveInterval int64
+	// DNS server (host:port) for backend discovery, empty means system resolver
+	DNSServer string
+	// DNS lookups of backend discovery, a resolver of DNSServer by default;
+	// library users and tests can set a stub
+	Resolver Resolver
+	// Capacity of the send queue
+	QueueSize int
+	// Number of sender goroutines
+	Senders int
+	// One of OverflowPolicy* constants
+	OverflowPolicy string
+	// Called when backend becomes alive or dead, nil if not needed
+	OnHealthChange func(backend *StatsDBackend, alive bool)
+	// Returns persisted mode of a new backend by its key, empty mode means active; nil if not needed
+	InitialMode func(backendKey string) string
+}
+
+// Returns options with the node's overrides applied
+// returns an error if resulting options are invalid
+func (options BackendOptions) forNode(node StatsdNode) (BackendOptions, error) {
+	if node.QueueSize > 0 {
+		options.QueueSize = node.QueueSize
+	}
+	if node.OverflowPolicy != "" {
+		options.OverflowPolicy = node.OverflowPolicy
+	}
+	if node.HealthCheck != nil {
+		if node.HealthCheck.Rise > 0 {
+			options.Rise = node.HealthCheck.Rise
+		}
+		if node.HealthCheck.Fall > 0 {
+			options.Fall = node.HealthCheck.Fall
+		}
+	}
+	if options.Rise <= 0 {
+		options.Rise = DefaultHealthCheckRise
+	}
+	if options.Fall <= 0 {
+		options.Fall = DefaultHealthCheckFall
+	}
+	if options.CheckInterval <= 0 {
+		options.CheckInterval = DefaultCheckInterval
+	}
+	if options.UnhealthyCheckInterval <= 0 || (options.CheckInterval > 0 && options.UnhealthyCheckInterval > options.CheckInterval) {
+		options.UnhealthyCheckInterval = options.CheckInterval
+	}
+	defaults := DefaultPipelineConfig()
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaults.QueueSize
+	}
+	if options.Senders <= 0 {
+		options.Senders = defaults.Senders
+	}
+	switch options.OverflowPolicy {
+	case "":
+		options.OverflowPolicy = OverflowPolicyBlock
+	case OverflowPolicyBlock, OverflowPolicyDropNewest, OverflowPolicyDropOldest:
+	default:
+		return options, fmt.Errorf("unknown overflow policy %q", options.OverflowPolicy)
+	}
+	return options, nil
+}
+
 // StatsD Backend struct
 type StatsDBackend struct {
 	Host           string
 	Port           uint16
 	ManagementPort uint16
-	conn           net.Conn
-	ManagementConn net.Conn
-	SendChannel    chan []byte
-	Status         struct {
-		Alive        bool
-		LastPingTime int64
+	// One of BackendType* constants
+	Type string
+	// connection is replaced when the hostname resolves to another address
+	conn atomic.Pointer[net.UDPConn]
+	// held for reading by senders while they write to conn, so the replaced connection
+	// is closed only after writes in flight are finished
+	connWrites  sync.RWMutex
+	SendChannel chan []byte
+	// health state, it is written by the alive checker only and replaced as a whole,
+	// so readers get a consistent snapshot without a lock
+	status atomic.Pointer[BackendHealth]
+	Stats  struct {
+		PacketsSent atomic.Uint64
+		BytesSent   atomic.Uint64
+		SendErrors  atomic.Uint64
+		// Send errors reported to the health checker
+		PassiveFailures atomic.Uint64
+		AddressChanges  atomic.Uint64
+		Dropped         atomic.Uint64
+		QueueDrops      atomic.Uint64
+		// Metrics the backend type doesn't accept
+		Rejected atomic.Uint64
+
+		HealthChecksUp             atomic.Uint64
+		HealthChecksDown           atomic.Uint64
+		HealthCheckNanoseconds     atomic.Uint64
+		LastHealthCheckNanoseconds atomic.Uint64
 	}
-	healthCheckInterval int64
-	quit                chan bool
-	wg                  sync.WaitGroup
+	resolveInterval              int64
+	healthCheckInterval          int64
+	unhealthyHealthCheckInterval int64
+	rise                         int64
+	fall                         int64
+	onHealthChange               func(backend *StatsDBackend, alive bool)
+	// passive signals for the alive checker, buffered so senders never block
+	suspect        chan struct{}
+	overflowPolicy string
+	senders        int
+	healthChecker  HealthChecker
+	// one of BackendMode* constants, it is changed by the API while metric handlers read it
+	mode atomic.Pointer[string]
+	// creates writers of senders of backends which don't speak StatsD, nil for statsd backends
+	newWriter      func() batchWriter
+	batchSize      int
+	flushInterval  time.Duration
+	rejectedLogger *RateLimitedLogger
+	spool          *Spool
+	logger         *slog.Logger
+	sheddingLogger *RateLimitedLogger
+	// canceled when backend is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// goroutines which stop when ctx is canceled
+	wg sync.WaitGroup
+	// senders stop when SendChannel is closed and drained
+	sendersWG sync.WaitGroup
+	// protects SendChannel from being written after it is closed
+	closeLock sync.RWMutex
+	closed    bool
+	// set when the queue was not flushed before shutdown deadline, senders discard the rest
+	discarding atomic.Bool
+	// closed together with setting discarding, it interrupts waiting for a batch retry
+	discard chan struct{}
+}
+
+// Health state of a backend
+type BackendHealth struct {
+	Alive                bool
+	LastPingTime         int64
+	ConsecutiveFailures  int64
+	ConsecutiveSuccesses int64
+	// Set by passive signals (send errors) until the next successful check
+	Suspect bool
 }
 
-func (backend StatsDBackend) String() string {
+// Returns a snapshot of the backend's health state
+func (backend *StatsDBackend) Status() BackendHealth {
+	return *backend.status.Load()
+}
+
+func (backend *StatsDBackend) String() string {
 	return fmt.Sprintf("StatsDBackend{Host:%q, Port:%d, ManagementPort:%d}", backend.Host, backend.Port, backend.ManagementPort)
 }
 
+// Returns backend key in host:port:mgmt_port format
+func (backend *StatsDBackend) Key() string {
+	return fmt.Sprintf("%s:%d:%d", backend.Host, backend.Port, backend.ManagementPort)
+}
+
 // Creates a new StatsDBackend struct
-// accepts a host, port, managementPort and checkInterval as parameters
+// accepts a StatsdNode, BackendOptions and logger as parameters
 // returns the StatsDBackend struct and an error
-func NewStatsDBackend(host string, port uint16, managementPort uint16, checkInterval int64) (*StatsDBackend, error) {
-	backend := StatsDBackend{Host: host, Port: port, ManagementPort: managementPort, healthCheckInterval: checkInterval}
-	backend.SendChannel = make(chan []byte, ChannelSize)
-	backend.quit = make(chan bool)
-	err := backend.Open()
+func NewStatsDBackend(node StatsdNode, options BackendOptions, logger *slog.Logger) (*StatsDBackend, error) {
+	backend := &StatsDBackend{Host: node.Host, Port: node.Port, ManagementPort: node.ManagementPort, Type: node.Type}
+	backend.logger = logger.With("backend", backend.Key())
+	backend.sheddingLogger = NewRateLimitedLogger(backend.logger, 10*time.Second)
+	backend.rejectedLogger = NewRateLimitedLogger(backend.logger, 10*time.Second)
+	options, err := options.forNode(node)
 	if err != nil {
-		log.Printf("Failed to create %s: %s", backend, err)
+		backend.logger.Error("Failed to create backend", "error", err)
 		return nil, err
 	}
-	err = backend.OpenManagementConnection()
+	switch node.Type {
+	case "":
+		backend.Type = BackendTypeStatsd
+	case BackendTypeStatsd:
+	case BackendTypeGraphite:
+		var config GraphiteConfig
+		if node.Graphite != nil {
+			config = *node.Graphite
+		}
+		if config, err = config.normalize(); err != nil {
+			backend.logger.Error("Failed to create backend", "error", err)
+			return nil, err
+		}
+		address := net.JoinHostPort(node.Host, fmt.Sprint(node.Port))
+		backend.newWriter = func() batchWriter { return newGraphiteWriter(address, config, backend.logger) }
+		backend.batchSize = config.BatchSize
+		backend.flushInterval = time.Duration(config.FlushInterval) * time.Second
+	case BackendTypeInflux:
+		var config InfluxConfig
+		if node.Influx != nil {
+			config = *node.Influx
+		}
+		if config, err = config.normalize(node); err == nil {
+			backend.newWriter, err = newInfluxWriterFactory(node, config, backend.logger)
+		}
+		if err != nil {
+			backend.logger.Error("Failed to create backend", "error", err)
+			return nil, err
+		}
+		backend.batchSize = config.BatchSize
+		backend.flushInterval = time.Duration(config.FlushInterval) * time.Second
+	default:
+		err = fmt.Errorf("unknown backend type %q", node.Type)
+		backend.logger.Error("Failed to create backend", "error", err)
+		return nil, err
+	}
+	backend.resolveInterval = options.ResolveInterval
+	backend.healthCheckInterval = options.CheckInterval
+	backend.unhealthyHealthCheckInterval = options.UnhealthyCheckInterval
+	backend.rise = int64(options.Rise)
+	backend.fall = int64(options.Fall)
+	backend.onHealthChange = options.OnHealthChange
+	backend.suspect = make(chan struct{}, 1)
+	backend.status.Store(&BackendHealth{})
+	backend.overflowPolicy = options.OverflowPolicy
+	backend.senders = options.Senders
+	active := BackendModeActive
+	backend.mode.Store(&active)
+	if options.InitialMode != nil {
+		if mode := options.InitialMode(backend.Key()); mode != "" {
+			if err := backend.SetMode(mode); err != nil {
+				backend.logger.Error("Failed to restore backend mode", "error", err)
+			}
+		}
+	}
+	backend.SendChannel = make(chan []byte, options.QueueSize)
+	backend.discard = make(chan struct{})
+	backend.ctx, backend.cancel = context.WithCancel(context.Background())
+	if node.Spool != nil {
+		backend.spool, err = OpenSpool(*node.Spool, backend.Key(), backend.logger)
+		if err != nil {
+			backend.logger.Error("Failed to create backend", "error", err)
+			return nil, err
+		}
+	}
+	// backends with batch writers connect in their senders
+	if backend.newWriter == nil {
+		err = backend.Open()
+		if err != nil {
+			backend.logger.Error("Failed to create backend", "error", err)
+			return nil, err
+		}
+	}
+	backend.healthChecker, err = NewHealthChecker(node, backend.logger)
 	if err != nil {
-		log.Printf("Failed to create %s: %s", backend, err)
+		backend.logger.Error("Failed to create backend", "error", err)
 		return nil, err
 	}
 	backend.CreateAliveChecker()
 	backend.CreateSender()
-	return &backend, nil
+	if backend.resolveInterval > 0 && net.ParseIP(backend.Host) == nil && backend.newWriter == nil {
+		backend.CreateResolver()
+	}
+	if backend.spool != nil {
+		backend.CreateSpoolReplayer()
+	}
+	return backend, nil
 }
 
 // Opens udp connection
 func (backend *StatsDBackend) Open() error {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", backend.Host, backend.Port))
 	if err != nil {
-		log.Printf("Error resolving UDP address [%s:%d]: %s", backend.Host, backend.Port, err)
+		backend.logger.Error("Error resolving UDP address", "host", backend.Host, "port", backend.Port, "error", err)
 		return err
 	}
 
 	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
-		log.Printf("Error dial to UDP address %v: %s", addr, err)
+		backend.logger.Error("Error dial to UDP address", "address", addr.String(), "error", err)
 		return err
 	}
-	backend.conn = conn
+	backend.conn.Store(conn)
 	return nil
 }
 
-// Opens TCP connection to the management port
-func (backend *StatsDBackend) OpenManagementConnection() error {
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", backend.Host, backend.ManagementPort))
-	if err != nil {
-		log.Printf("Error resolving TCP address [%s:%d]: %s", backend.Host, backend.ManagementPort, err)
-		return err
+// Returns the address backend's connection is dialed to
+// or host:port for backends which connect in their senders
+func (backend *StatsDBackend) Address() string {
+	if conn := backend.conn.Load(); conn != nil {
+		return conn.RemoteAddr().String()
 	}
+	return net.JoinHostPort(backend.Host, fmt.Sprint(backend.Port))
+}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
-	handled := false
+// Creates resolver
+// It re-resolves backend hostname every resolveInterval seconds
+// and re-dials the connection when the address changes
+func (backend *StatsDBackend) CreateResolver() {
+	backend.logger.Debug("Creating resolver goroutine")
+	backend.wg.Add(1)
+	go func() {
+		defer backend.wg.Done()
+		tick := time.NewTicker(time.Duration(backend.resolveInterval) * time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				backend.reresolve()
+			case <-backend.ctx.Done():
+				backend.logger.Debug("Terminating resolver goroutine")
+				return
+			}
+		}
+	}()
+}
+
+// Resolves backend hostname and switches the connection to the new address if it has changed
+// the old connection is kept when resolving or dialing fails
+func (backend *StatsDBackend) reresolve() {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", backend.Host, backend.Port))
 	if err != nil {
-		log.Printf("Error dial to TCP address %v: %s", addr, err)
-		// TODO: add *net.timeoutError handling
-		if opErr, ok := err.(*net.OpError); ok {
-			if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
-				if sysErr.Err == syscall.ECONNREFUSED {
-					handled = true
-					log.Println("Got ECONNREFUSED!")
-				}
+		backend.logger.Warn("Error re-resolving UDP address, keeping the old one", "address", backend.Address(), "error", err)
+		return
+	}
+	old := backend.conn.Load()
+	if addr.String() == old.RemoteAddr().String() {
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		backend.logger.Warn("Error dial to new UDP address, keeping the old one", "address", addr.String(), "error", err)
+		return
+	}
+	backend.conn.Store(conn)
+	backend.Stats.AddressChanges.Add(1)
+	backend.logger.Info("Backend address changed", "from", old.RemoteAddr().String(), "to", addr.String())
+	// new writes use the new connection, wait for the ones which still use the old one
+	backend.connWrites.Lock()
+	backend.connWrites.Unlock()
+	old.Close()
+}
+
+// Shutdown goroutines, flush the send queue and close all connections
+// metrics which are not sent before ctx is done are spooled if backend has a spool or dropped
+// returns an error if the queue was not flushed or the spool can't be closed
+func (backend *StatsDBackend) Close(ctx context.Context) error {
+	var err error
+	backend.logger.Info("Terminating backend", "queued", len(backend.SendChannel))
+	backend.cancel()
+	backend.wg.Wait()
+	backend.closeLock.Lock()
+	if backend.closed {
+		backend.closeLock.Unlock()
+		return errors.New("backend is already closed")
+	}
+	backend.closed = true
+	close(backend.SendChannel)
+	backend.closeLock.Unlock()
+	if !waitWithContext(ctx, &backend.sendersWG) {
+		err = fmt.Errorf("send queue was not flushed, %d metrics remaining: %w", len(backend.SendChannel), ctx.Err())
+		backend.discarding.Store(true)
+		close(backend.discard)
+		backend.sendersWG.Wait()
+	}
+	if backend.spool != nil {
+		if spoolErr := backend.spool.Close(); spoolErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close spool: %w", spoolErr))
+		}
+	}
+	backend.healthChecker.Close()
+	if conn := backend.conn.Load(); conn != nil {
+		conn.Close()
+	}
+	backend.logger.Info("Backend terminated")
+	return err
+}
+
+// Returns overflow policy of the backend
+func (backend *StatsDBackend) OverflowPolicy() string {
+	return backend.overflowPolicy
+}
+
+// Puts a metric into the send queue according to backend's overflow policy
+// with block policy it waits for free space until the backend is closed, Close cancels ctx
+// before it takes closeLock, so a waiting metric handler doesn't hold up the shutdown
+// returns false if the metric was dropped because the queue is full or backend is terminated
+func (backend *StatsDBackend) Enqueue(metric []byte) bool {
+	backend.closeLock.RLock()
+	defer backend.closeLock.RUnlock()
+	if backend.closed {
+		backend.Stats.Dropped.Add(1)
+		return false
+	}
+	switch backend.overflowPolicy {
+	case OverflowPolicyDropNewest:
+		select {
+		case backend.SendChannel <- metric:
+		default:
+			backend.queueOverflowed()
+			return false
+		}
+	case OverflowPolicyDropOldest:
+		for {
+			select {
+			case backend.SendChannel <- metric:
+				return true
+			default:
+			}
+			select {
+			case <-backend.SendChannel:
+				backend.queueOverflowed()
+			default:
 			}
 		}
-		if !handled {
-			return err
+	default:
+		select {
+		case backend.SendChannel <- metric:
+		case <-backend.ctx.Done():
+			backend.Stats.Dropped.Add(1)
+			return false
 		}
 	}
-	if handled {
-		backend.ManagementConn = nil
-	} else {
-		backend.ManagementConn = conn
+	return true
+}
+
+// Puts a metric into the send queue if it has free space, it never blocks or evicts queued metrics
+// returns false if the queue is full or backend is terminated
+func (backend *StatsDBackend) offer(metric []byte) bool {
+	backend.closeLock.RLock()
+	defer backend.closeLock.RUnlock()
+	if backend.closed {
+		return false
+	}
+	select {
+	case backend.SendChannel <- metric:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-// Shutdown goroutines and close all connections
-func (backend *StatsDBackend) Exit(externalWG *sync.WaitGroup) {
-	defer externalWG.Done()
-	log.Println("Terminating backend:", backend)
-	close(backend.quit)
-	close(backend.SendChannel)
-	backend.wg.Wait()
-	if backend.ManagementConn != nil {
-		backend.ManagementConn.Close()
+// Counts a metric dropped because of full queue and warns that backend is shedding
+func (backend *StatsDBackend) queueOverflowed() {
+	drops := backend.Stats.QueueDrops.Add(1)
+	backend.sheddingLogger.Warn("Backend queue is full, shedding metrics", "policy", backend.overflowPolicy, "queue_size", cap(backend.SendChannel), "queue_drops", drops)
+}
+
+// Returns the spool of the backend or nil if spooling is not enabled
+func (backend *StatsDBackend) Spool() *Spool {
+	return backend.spool
+}
+
+// Writes a metric which can't be sent now to the spool
+// metrics are not spooled when backend has no spool or is draining
+// returns true if the metric was spooled
+func (backend *StatsDBackend) SpoolMetric(metric []byte) bool {
+	if backend.spool == nil || backend.Mode() == BackendModeDrain {
+		return false
+	}
+	if err := backend.spool.Write(metric); err != nil {
+		backend.sheddingLogger.Warn("Failed to spool metric", "error", err)
+		return false
 	}
-	backend.conn.Close()
-	log.Println("TERMINATED backend:", backend)
+	return true
+}
+
+// Creates spool replayer
+// It sends spooled metrics at the configured rate while backend is alive and active
+func (backend *StatsDBackend) CreateSpoolReplayer() {
+	backend.logger.Debug("Creating spool replayer goroutine")
+	backend.wg.Add(1)
+	go func() {
+		defer backend.wg.Done()
+		tick := time.NewTicker(spoolReplayTick)
+		defer tick.Stop()
+		flushTick := time.NewTicker(time.Second)
+		defer flushTick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if !backend.Status().Alive || backend.Mode() != BackendModeActive || backend.spool.Empty() {
+					continue
+				}
+				// a metric stays in the spool until it is queued, replay never evicts queued metrics
+				queued := 0
+				for _, metric := range backend.spool.Peek(backend.spool.replayBatch()) {
+					if !backend.offer(metric) {
+						break
+					}
+					queued++
+				}
+				backend.spool.Ack(queued)
+			case <-flushTick.C:
+				backend.spool.Flush()
+			case <-backend.ctx.Done():
+				backend.logger.Debug("Terminating spool replayer goroutine")
+				return
+			}
+		}
+	}()
 }
 
 // Creates senders
+// They send metrics until SendChannel is closed and drained
 func (backend *StatsDBackend) CreateSender() {
-	if DebugMode {
-		log.Printf("Creating sender goroutine for %s", backend)
-	}
-	for i := 0; i < WorkerCount; i++ {
-		backend.wg.Add(1)
+	backend.logger.Debug("Creating sender goroutines")
+	for i := 0; i < backend.senders; i++ {
+		backend.sendersWG.Add(1)
+		if backend.newWriter != nil {
+			go func(index int) {
+				defer backend.sendersWG.Done()
+				backend.runBatchSender(backend.newWriter())
+				backend.logger.Debug("Terminating sender goroutine", "index", index)
+			}(i)
+			continue
+		}
 		go func(index int) {
-			defer backend.wg.Done()
+			defer backend.sendersWG.Done()
 			for metric := range backend.SendChannel {
-				if DebugMode {
-					log.Printf("Sending %s to backend %s", metric, backend)
+				if backend.discarding.Load() {
+					if !backend.SpoolMetric(metric) {
+						backend.Stats.Dropped.Add(1)
+					}
+					continue
 				}
-				if _, err := backend.conn.Write(metric); err != nil {
-					log.Println(err)
+				if backend.logger.Enabled(context.Background(), slog.LevelDebug) {
+					backend.logger.Debug("Sending metric", "metric", string(metric))
 				}
+				backend.connWrites.RLock()
+				_, err := backend.conn.Load().Write(metric)
+				backend.connWrites.RUnlock()
+				if err != nil {
+					backend.Stats.SendErrors.Add(1)
+					backend.logger.Warn("Failed to send metric", "error", err)
+					backend.reportSendError()
+					continue
+				}
+				backend.Stats.PacketsSent.Add(1)
+				backend.Stats.BytesSent.Add(uint64(len(metric)))
 			}
-			if DebugMode {
-				log.Printf("Terminating Sender goroutine #%d of backend %s", index, backend)
-			}
+			backend.logger.Debug("Terminating sender goroutine", "index", index)
 		}(i)
 	}
 }
 
+// Converts queued metrics with the writer and writes them in batches of up to batchSize lines
+// at least every flushInterval until SendChannel is closed and drained
+// a failed batch is retried maxBatchWriteAttempts times with growing delay, then its packets
+// are spooled or dropped; after shutdown deadline batches are not retried anymore
+func (backend *StatsDBackend) runBatchSender(writer batchWriter) {
+	defer writer.close()
+	var batch []byte
+	var packets [][]byte
+	lines := 0
+	// spools or drops the packets of the batch
+	discardBatch := func() {
+		for _, packet := range packets {
+			if !backend.SpoolMetric(packet) {
+				backend.Stats.Dropped.Add(1)
+			}
+		}
+	}
+	flush := func() {
+		if lines == 0 {
+			return
+		}
+		defer func() {
+			batch, packets, lines = batch[:0], packets[:0], 0
+		}()
+		delay := minBatchRetryDelay
+		for attempt := 1; ; attempt++ {
+			if backend.discarding.Load() {
+				discardBatch()
+				return
+			}
+			err := writer.write(batch)
+			if err == nil {
+				backend.Stats.PacketsSent.Add(1)
+				backend.Stats.BytesSent.Add(uint64(len(batch)))
+				return
+			}
+			backend.Stats.SendErrors.Add(1)
+			if errors.Is(err, errBatchRefused) {
+				backend.logger.Warn("Backend refused batch, dropping it", "lines", lines, "error", err)
+				backend.Stats.Dropped.Add(uint64(len(packets)))
+				return
+			}
+			backend.reportSendError()
+			if attempt == maxBatchWriteAttempts {
+				backend.logger.Warn("Failed to send batch, spooling or dropping it", "lines", lines, "attempts", attempt, "error", err)
+				discardBatch()
+				return
+			}
+			backend.logger.Warn("Failed to send batch, retrying", "lines", lines, "delay", delay, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-backend.discard:
+			}
+			delay *= 2
+		}
+	}
+	tick := time.NewTicker(backend.flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case packet, ok := <-backend.SendChannel:
+			if !ok {
+				flush()
+				return
+			}
+			if backend.discarding.Load() {
+				if !backend.SpoolMetric(packet) {
+					backend.Stats.Dropped.Add(1)
+				}
+				continue
+			}
+			if backend.logger.Enabled(context.Background(), slog.LevelDebug) {
+				backend.logger.Debug("Sending metric", "metric", string(packet))
+			}
+			now := time.Now()
+			queued := lines
+			for _, metric := range parsePacket(packet) {
+				var accepted bool
+				if metric.err == nil {
+					batch, accepted = writer.format(batch, metric, now)
+				}
+				if !accepted {
+					rejected := backend.Stats.Rejected.Add(1)
+					backend.rejectedLogger.Warn("Backend doesn't accept metric", "type", backend.Type, "metric", string(metric.Raw()), "rejected", rejected)
+					continue
+				}
+				lines++
+			}
+			if lines > queued {
+				packets = append(packets, packet)
+			}
+			if lines >= backend.batchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
 // Creates aliveness checker
-// This checker will check backend every healthCheckInterval seconds
+// This checker will check backend every healthCheckInterval seconds,
+// every unhealthyHealthCheckInterval seconds while backend is down, its state is changing
+// or it is suspect, and immediately after a passive failure signal
+// Intervals are jittered to spread checks of different backends
 func (backend *StatsDBackend) CreateAliveChecker() {
-	if DebugMode {
-		log.Printf("Creating alive checker goroutine for %s", backend)
-	}
+	backend.logger.Debug("Creating alive checker goroutine")
 
-	backend.Status.Alive = backend.CheckAliveStatus()
-	if !backend.Status.Alive {
-		log.Printf("Freshly created backend %s is not alive by the way", backend)
+	backend.checkHealth()
+	if !backend.Status().Alive {
+		backend.logger.Warn("Freshly created backend is not alive")
 	}
 
 	backend.wg.Add(1)
 	go func() {
 		defer backend.wg.Done()
-		tick := time.Tick(time.Duration(backend.healthCheckInterval) * time.Second)
+		// the first check is scheduled anywhere in the interval so backends created together don't check in sync
+		timer := time.NewTimer(time.Duration(rand.Int64N(int64(backend.nextCheckDelay()) + 1)))
+		defer timer.Stop()
 		for {
 			select {
-			case <-tick:
-				backend.Status.Alive = backend.CheckAliveStatus()
-			case <-backend.quit:
-				log.Printf("Terminating CreateAliveChecker goroutine for backend %s", backend)
+			case <-timer.C:
+				backend.checkHealth()
+			case <-backend.suspect:
+				status := backend.Status()
+				if !status.Alive {
+					continue
+				}
+				if !status.Suspect {
+					backend.logger.Warn("Backend is suspect because of send errors, checking it now")
+					status.Suspect = true
+					backend.status.Store(&status)
+				}
+				backend.checkHealth()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			case <-backend.ctx.Done():
+				backend.logger.Debug("Terminating alive checker goroutine")
 				return
 			}
+			timer.Reset(backend.nextCheckDelay())
 		}
 	}()
 }
 
-// Checks aliveness of backend
-// Function tries to reconnect to management port 'retryCount' times
-// returns false or true
-func (backend *StatsDBackend) CheckAliveStatus() bool {
-	var err error
-	var retryCount = 0
-	if DebugMode {
-		log.Printf("Checking backend %s", backend)
-	}
-	statusString := []byte("health")
-	// TODO: don't make last backend.OpenManagementConnection call if we already exceeded retryCount
-Retry:
-	if retryCount > 1 {
-		log.Printf("Give up after #%d attemps for %s", retryCount, backend)
-		return false
+// Returns delay before the next health check with ±healthCheckJitter applied
+func (backend *StatsDBackend) nextCheckDelay() time.Duration {
+	interval := backend.healthCheckInterval
+	if status := backend.Status(); !status.Alive || status.Suspect || status.ConsecutiveFailures > 0 {
+		interval = backend.unhealthyHealthCheckInterval
 	}
-	if backend.ManagementConn == nil {
-		err = backend.OpenManagementConnection()
-		if err != nil || backend.ManagementConn == nil {
-			if err != nil {
-				log.Printf("Failed to OpenManagementConnection for %s: %s", backend, err)
-			} else {
-				log.Printf("Failed to OpenManagementConnection for %s: the connection is still not initialized", backend)
-			}
-			retryCount++
-			log.Printf("Retry #%d for %s", retryCount, backend)
-			goto Retry
-		}
+	delay := time.Duration(interval) * time.Second
+	jitter := int64(float64(delay) * healthCheckJitter)
+	if jitter > 0 {
+		delay += time.Duration(rand.Int64N(2*jitter+1) - jitter)
 	}
-	backend.ManagementConn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-	_, err = backend.ManagementConn.Write(statusString)
-	if err != nil {
-		log.Printf("Write to %s failed: %s", backend, err)
-		retryCount++
-		log.Printf("Retry #%d for %s", retryCount, backend)
-		err = backend.OpenManagementConnection()
-		if err != nil {
-			log.Printf("Failed to OpenManagementConnection for %s: %s", backend, err)
-			return false
-		}
-		goto Retry
+	return delay
+}
+
+// Reports a passive failure signal to the alive checker
+// never blocks, signals are merged while the checker is busy
+func (backend *StatsDBackend) reportSendError() {
+	backend.Stats.PassiveFailures.Add(1)
+	select {
+	case backend.suspect <- struct{}{}:
+	default:
 	}
-	reply := make([]byte, 1024)
+}
 
-	backend.ManagementConn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	_, err = backend.ManagementConn.Read(reply)
-	if err != nil {
-		log.Printf("Read from %s failed: %s", backend, err)
-		retryCount++
-		log.Printf("Retry #%d for %s", retryCount, backend)
-		err = backend.OpenManagementConnection()
-		if err != nil {
-			log.Printf("Failed to OpenManagementConnection for %s: %s", backend, err)
-			return false
-		}
-		goto Retry
+// Switches backend to another mode
+// accepts one of BackendMode* constants
+// returns an error
+func (backend *StatsDBackend) SetMode(mode string) error {
+	if err := checkBackendMode(mode); err != nil {
+		return err
 	}
-	healthStatus := strings.Trim(string(reply), string(0))
+	if old := backend.mode.Swap(&mode); *old != mode {
+		backend.logger.Info("Switching backend mode", "from", *old, "to", mode)
+	}
+	return nil
+}
 
-	if DebugMode {
-		log.Printf("Response from backend %s: %s", backend, healthStatus)
+// Checks that the mode is one of BackendMode* constants
+// returns an error
+func checkBackendMode(mode string) error {
+	switch mode {
+	case BackendModeActive, BackendModeDrain, BackendModeMaintenance:
+		return nil
 	}
-	if strings.Contains(healthStatus, "up") {
-		if DebugMode {
-			log.Printf("Backend %s is up", backend)
-		}
-		return true
+	return fmt.Errorf("unknown backend mode %q", mode)
+}
+
+// Returns current mode of the backend, one of BackendMode* constants
+func (backend *StatsDBackend) Mode() string {
+	return *backend.mode.Load()
+}
+
+// Runs the health check and stores its result in backend's status and Stats
+// backend is marked down after fall consecutive failures and up after rise consecutive successes,
+// the very first check sets the state immediately
+func (backend *StatsDBackend) checkHealth() {
+	start := time.Now()
+	alive := backend.CheckAliveStatus()
+	duration := uint64(time.Since(start))
+	backend.Stats.HealthCheckNanoseconds.Add(duration)
+	backend.Stats.LastHealthCheckNanoseconds.Store(duration)
+
+	status := backend.Status()
+	firstCheck := status.LastPingTime == 0
+	wasAlive := status.Alive
+	status.LastPingTime = start.Unix()
+	if alive {
+		backend.Stats.HealthChecksUp.Add(1)
+		status.ConsecutiveFailures = 0
+		status.ConsecutiveSuccesses++
+		status.Suspect = false
 	} else {
-		if DebugMode {
-			log.Printf("Backend %s is down", backend)
-		}
-		return false
+		backend.Stats.HealthChecksDown.Add(1)
+		status.ConsecutiveSuccesses = 0
+		status.ConsecutiveFailures++
 	}
+	switch {
+	case firstCheck:
+		status.Alive = alive
+	case !status.Alive && status.ConsecutiveSuccesses >= backend.rise:
+		backend.logger.Info("Backend is up", "consecutive_successes", status.ConsecutiveSuccesses)
+		status.Alive = true
+	case status.Alive && status.ConsecutiveFailures >= backend.fall:
+		backend.logger.Warn("Backend is down", "consecutive_failures", status.ConsecutiveFailures)
+		status.Alive = false
+		status.Suspect = false
+	}
+	backend.status.Store(&status)
+	if backend.onHealthChange != nil && status.Alive != wasAlive {
+		backend.onHealthChange(backend, status.Alive)
+	}
+}
+
+// Checks aliveness of backend with its health checker
+// returns false or true
+func (backend *StatsDBackend) CheckAliveStatus() bool {
+	return backend.healthChecker.Check()
 }
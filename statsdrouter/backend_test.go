@@ -0,0 +1,153 @@
+package statsdrouter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a local TCP port nothing listens on
+func closedPort(t *testing.T) uint16 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return uint16(port)
+}
+
+// Creates a graphite backend whose Carbon refuses connections, so every batch write fails
+func newFailingBackend(t *testing.T, queueSize int, policy string) *StatsDBackend {
+	t.Helper()
+	node := StatsdNode{
+		Host:        "127.0.0.1",
+		Port:        closedPort(t),
+		Type:        BackendTypeGraphite,
+		Graphite:    &GraphiteConfig{BatchSize: 1},
+		HealthCheck: &HealthCheckConfig{Type: HealthCheckNone},
+	}
+	backend, err := NewStatsDBackend(node, BackendOptions{
+		CheckInterval:          3600,
+		UnhealthyCheckInterval: 3600,
+		QueueSize:              queueSize,
+		Senders:                1,
+		OverflowPolicy:         policy,
+	}, discardLogger)
+	if err != nil {
+		t.Fatalf("NewStatsDBackend failed: %v", err)
+	}
+	return backend
+}
+
+func TestBatchSenderDropsBatchAfterRetries(t *testing.T) {
+	backend := newFailingBackend(t, 16, OverflowPolicyDropNewest)
+	defer backend.Close(context.Background())
+
+	backend.Enqueue([]byte("hits:1|c"))
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.Stats.Dropped.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not dropped, %d send errors", backend.Stats.SendErrors.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := backend.Stats.SendErrors.Load(); got != maxBatchWriteAttempts {
+		t.Fatalf("batch was written %d times, want %d", got, maxBatchWriteAttempts)
+	}
+}
+
+func TestCloseReleasesBlockedEnqueue(t *testing.T) {
+	backend := newFailingBackend(t, 1, OverflowPolicyBlock)
+	// the sender retries the first metric, the second one fills the queue
+	backend.Enqueue([]byte("hits:1|c"))
+	backend.Enqueue([]byte("hits:2|c"))
+	blocked := make(chan bool)
+	go func() {
+		blocked <- backend.Enqueue([]byte("hits:3|c"))
+	}()
+	select {
+	case <-blocked:
+		t.Skip("the queue was drained before the third metric, nothing blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	closed := make(chan error)
+	go func() { closed <- backend.Close(ctx) }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close doesn't return while a metric handler waits in Enqueue")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Close took %v with shutdown timeout of 100ms", elapsed)
+	}
+	if <-blocked {
+		t.Fatal("metric enqueued after Close was reported as queued")
+	}
+}
+
+func TestBackendStatusIsReadWhileChecksRun(t *testing.T) {
+	router := newTestRouter(t, &RouterConfig{
+		Rules: map[string][]StatsdNode{`^app\.`: {{Host: "127.0.0.1", Port: 18210, ManagementPort: 18211}}},
+	})
+	server := newTestAPIServer(t, router)
+	backend := router.Backend("127.0.0.1:18210:18211")
+
+	// every passive failure signal makes the alive checker run a check right away
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			backend.reportSendError()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			router.InjectMetrics([]byte("app.hits:1|c"))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		response, err := http.Get(server.URL + "/backends")
+		if err != nil {
+			t.Fatalf("GET /backends failed: %v", err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("GET /backends returned %d", response.StatusCode)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if status := backend.Status(); !status.Alive || status.LastPingTime == 0 {
+		t.Fatalf("backend with none check has status %+v", status)
+	}
+	if backend.Stats.HealthChecksUp.Load() < 2 {
+		t.Fatal("passive failures didn't trigger health checks")
+	}
+}
@@ -0,0 +1,269 @@
+// Limits of distinct metric names per prefix
+package statsdrouter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens with new names over the limit
+const (
+	// metric is dropped
+	CardinalityActionDrop = "drop"
+	// metric is sent only to the quarantine backend
+	CardinalityActionQuarantine = "quarantine"
+	// metric is renamed to the overflow name
+	CardinalityActionOverflow = "overflow"
+)
+
+// Default max number of groups tracked by a cardinality limiter
+const DefaultCardinalityMaxGroups = 1000
+
+// Cardinality limit settings
+type CardinalityLimitConfig struct {
+	// Names with this prefix are checked, empty prefix matches all names
+	// when several prefixes match, the longest one is used
+	Prefix string `json:"prefix"`
+	// Number of leading dot separated name parts which form a group limited separately,
+	// 0 means all names with the prefix form one group
+	Depth int `json:"depth,omitempty"`
+	// Max number of distinct names in a group
+	MaxNames int `json:"max_names"`
+	// Max number of tracked groups, names of other groups are over the limit, 1000 by default
+	MaxGroups int `json:"max_groups,omitempty"`
+	// Interval of forgetting seen names in seconds, 0 means never
+	ResetInterval int64 `json:"reset_interval,omitempty"`
+	// One of CardinalityAction* constants, drop by default
+	Action string `json:"action,omitempty"`
+	// Key (host:port:mgmt_port) of the quarantine backend, it must be the master or a backend of a rule
+	Backend string `json:"backend,omitempty"`
+	// Name of metrics over the limit for overflow action, <group>.overflow by default
+	OverflowName string `json:"overflow_name,omitempty"`
+}
+
+// Checks settings and fills defaults
+// returns settings and an error
+func (config CardinalityLimitConfig) normalize() (CardinalityLimitConfig, error) {
+	if config.MaxNames <= 0 {
+		return config, errors.New("max_names has to be positive")
+	}
+	if config.Depth < 0 {
+		return config, errors.New("depth can't be negative")
+	}
+	if config.MaxGroups <= 0 {
+		config.MaxGroups = DefaultCardinalityMaxGroups
+	}
+	switch config.Action {
+	case "":
+		config.Action = CardinalityActionDrop
+	case CardinalityActionDrop, CardinalityActionOverflow:
+	case CardinalityActionQuarantine:
+		if config.Backend == "" {
+			return config, errors.New("quarantine backend is not set")
+		}
+	default:
+		return config, fmt.Errorf("unknown cardinality action %q", config.Action)
+	}
+	return config, nil
+}
+
+// Distinct names of one group
+type cardinalityGroup struct {
+	// admitted names, at most MaxNames of them
+	names map[string]struct{}
+	// all seen names including rejected ones
+	sketch   hyperLogLog
+	rejected uint64
+}
+
+// Tracks distinct names of groups of one prefix
+type CardinalityLimiter struct {
+	Config CardinalityLimitConfig
+	Stats  struct {
+		// Metrics with new names over the limit
+		Rejected atomic.Uint64
+	}
+	lock      sync.Mutex
+	groups    map[string]*cardinalityGroup
+	lastReset time.Time
+}
+
+// Creates a new CardinalityLimiter struct
+// accepts cardinality limit settings as parameter
+// returns the *CardinalityLimiter struct and an error
+func NewCardinalityLimiter(config CardinalityLimitConfig) (*CardinalityLimiter, error) {
+	config, err := config.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return &CardinalityLimiter{Config: config, groups: make(map[string]*cardinalityGroup), lastReset: time.Now()}, nil
+}
+
+// Returns group of the name
+func (limiter *CardinalityLimiter) group(name string) string {
+	if limiter.Config.Depth == 0 {
+		return limiter.Config.Prefix
+	}
+	end := 0
+	for i := 0; i < limiter.Config.Depth; i++ {
+		next := strings.IndexByte(name[end:], '.')
+		if next < 0 {
+			return name
+		}
+		end += next + 1
+	}
+	return name[:end-1]
+}
+
+// Returns name of metrics over the limit of the group
+func (limiter *CardinalityLimiter) overflowName(group string) string {
+	if limiter.Config.OverflowName != "" {
+		return limiter.Config.OverflowName
+	}
+	if group = strings.TrimSuffix(group, "."); group == "" {
+		return "overflow"
+	}
+	return group + ".overflow"
+}
+
+// Checks if the name is already known or its group has room for it
+// returns false and the group if the name is over the limit
+func (limiter *CardinalityLimiter) Admit(name string) (bool, string) {
+	groupName := limiter.group(name)
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if interval := limiter.Config.ResetInterval; interval > 0 && time.Since(limiter.lastReset) >= time.Duration(interval)*time.Second {
+		limiter.groups = make(map[string]*cardinalityGroup)
+		limiter.lastReset = time.Now()
+	}
+	group := limiter.groups[groupName]
+	if group == nil {
+		if len(limiter.groups) >= limiter.Config.MaxGroups {
+			limiter.Stats.Rejected.Add(1)
+			return false, groupName
+		}
+		group = &cardinalityGroup{names: make(map[string]struct{})}
+		limiter.groups[groupName] = group
+	}
+	if _, ok := group.names[name]; ok {
+		return true, groupName
+	}
+	group.sketch.add(name)
+	if len(group.names) < limiter.Config.MaxNames {
+		group.names[name] = struct{}{}
+		return true, groupName
+	}
+	group.rejected++
+	limiter.Stats.Rejected.Add(1)
+	return false, groupName
+}
+
+// Same as Admit, but doesn't record the name and doesn't count rejected ones
+// returns false and the group if the name would be over the limit
+func (limiter *CardinalityLimiter) check(name string) (bool, string) {
+	groupName := limiter.group(name)
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if interval := limiter.Config.ResetInterval; interval > 0 && time.Since(limiter.lastReset) >= time.Duration(interval)*time.Second {
+		return true, groupName
+	}
+	group := limiter.groups[groupName]
+	if group == nil {
+		return len(limiter.groups) < limiter.Config.MaxGroups, groupName
+	}
+	if _, ok := group.names[name]; ok {
+		return true, groupName
+	}
+	return len(group.names) < limiter.Config.MaxNames, groupName
+}
+
+// Distinct names of a group
+type CardinalityGroupStatus struct {
+	Prefix string `json:"prefix"`
+	Group  string `json:"group"`
+	// Admitted names
+	Names int `json:"names"`
+	// Estimated number of all seen names including rejected ones
+	EstimatedNames uint64 `json:"estimated_names"`
+	MaxNames       int    `json:"max_names"`
+	// Metrics with new names over the limit
+	Rejected uint64 `json:"rejected"`
+}
+
+// Returns status of all tracked groups
+func (limiter *CardinalityLimiter) Groups() []CardinalityGroupStatus {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	statuses := make([]CardinalityGroupStatus, 0, len(limiter.groups))
+	for name, group := range limiter.groups {
+		statuses = append(statuses, CardinalityGroupStatus{
+			Prefix:         limiter.Config.Prefix,
+			Group:          name,
+			Names:          len(group.names),
+			EstimatedNames: group.sketch.estimate(),
+			MaxNames:       limiter.Config.MaxNames,
+			Rejected:       group.rejected,
+		})
+	}
+	return statuses
+}
+
+// Active cardinality limiters sorted by prefix length, the longest first
+type cardinalityLimits []*CardinalityLimiter
+
+// Creates cardinality limiters
+// accepts cardinality limit settings
+// returns cardinalityLimits and an error
+func newCardinalityLimits(configs []CardinalityLimitConfig) (cardinalityLimits, error) {
+	limits := make(cardinalityLimits, 0, len(configs))
+	prefixes := make(map[string]bool, len(configs))
+	for i, config := range configs {
+		limiter, err := NewCardinalityLimiter(config)
+		if err != nil {
+			return nil, fmt.Errorf("cardinality limit %d: %w", i, err)
+		}
+		if prefixes[config.Prefix] {
+			return nil, fmt.Errorf("cardinality limit %d: duplicate prefix %q", i, config.Prefix)
+		}
+		prefixes[config.Prefix] = true
+		limits = append(limits, limiter)
+	}
+	sort.SliceStable(limits, func(i, j int) bool {
+		return len(limits[i].Config.Prefix) > len(limits[j].Config.Prefix)
+	})
+	return limits, nil
+}
+
+// Returns limiter of the longest prefix of the name or nil
+func (limits cardinalityLimits) forName(name string) *CardinalityLimiter {
+	for _, limiter := range limits {
+		if strings.HasPrefix(name, limiter.Config.Prefix) {
+			return limiter
+		}
+	}
+	return nil
+}
+
+// Returns groups of all limiters, the ones with most names first
+// accepts max number of groups, 0 means all of them
+func (limits cardinalityLimits) topGroups(count int) []CardinalityGroupStatus {
+	statuses := []CardinalityGroupStatus{}
+	for _, limiter := range limits {
+		statuses = append(statuses, limiter.Groups()...)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].EstimatedNames != statuses[j].EstimatedNames {
+			return statuses[i].EstimatedNames > statuses[j].EstimatedNames
+		}
+		return statuses[i].Group < statuses[j].Group
+	})
+	if count > 0 && len(statuses) > count {
+		statuses = statuses[:count]
+	}
+	return statuses
+}
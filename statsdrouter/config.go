@@ -8,23 +8,124 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"maps"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Statsd node struct
 type StatsdNode struct {
-	Host           string `json:"host"`
-	Port           uint16 `json:"port"`
-	ManagementPort uint16 `json:"mgmt_port"`
+	Host           string             `json:"host"`
+	Port           uint16             `json:"port"`
+	ManagementPort uint16             `json:"mgmt_port"`
+	QueueSize      int                `json:"queue_size,omitempty"`
+	OverflowPolicy string             `json:"overflow_policy,omitempty"`
+	Spool          *SpoolConfig       `json:"spool,omitempty"`
+	HealthCheck    *HealthCheckConfig `json:"health_check,omitempty"`
+	Discovery      *DiscoveryConfig   `json:"discovery,omitempty"`
+	// One of BackendType* constants, statsd by default
+	Type     string          `json:"type,omitempty"`
+	Graphite *GraphiteConfig `json:"graphite,omitempty"`
+	Influx   *InfluxConfig   `json:"influxdb,omitempty"`
+}
+
+// Returns node key in host:port:mgmt_port format
+// or in type:name format for discovery nodes
+func (node StatsdNode) Key() string {
+	if node.Discovery != nil {
+		return fmt.Sprintf("%s:%s", node.Discovery.Type, node.Discovery.source())
+	}
+	return fmt.Sprintf("%s:%d:%d", node.Host, node.Port, node.ManagementPort)
+}
+
+// Sizes of channels and numbers of goroutines of the router pipeline
+// zero values mean "not set"
+type PipelineConfig struct {
+	PacketChannelSize int `json:"packet_channel_size,omitempty"`
+	MetricChannelSize int `json:"metric_channel_size,omitempty"`
+	PacketHandlers    int `json:"packet_handlers,omitempty"`
+	MetricHandlers    int `json:"metric_handlers,omitempty"`
+	QueueSize         int `json:"queue_size,omitempty"`
+	Senders           int `json:"senders,omitempty"`
+}
+
+// Returns default pipeline settings based on GOMAXPROCS
+func DefaultPipelineConfig() PipelineConfig {
+	procs := runtime.GOMAXPROCS(0)
+	senders := procs
+	if senders > 4 {
+		senders = 4
+	}
+	return PipelineConfig{
+		PacketChannelSize: 256 * procs,
+		MetricChannelSize: 1024 * procs,
+		PacketHandlers:    procs,
+		MetricHandlers:    procs,
+		QueueSize:         1024,
+		Senders:           senders,
+	}
+}
+
+// Returns pipeline settings where values set in other replace the current ones
+func (pipeline PipelineConfig) Override(other PipelineConfig) PipelineConfig {
+	if other.PacketChannelSize > 0 {
+		pipeline.PacketChannelSize = other.PacketChannelSize
+	}
+	if other.MetricChannelSize > 0 {
+		pipeline.MetricChannelSize = other.MetricChannelSize
+	}
+	if other.PacketHandlers > 0 {
+		pipeline.PacketHandlers = other.PacketHandlers
+	}
+	if other.MetricHandlers > 0 {
+		pipeline.MetricHandlers = other.MetricHandlers
+	}
+	if other.QueueSize > 0 {
+		pipeline.QueueSize = other.QueueSize
+	}
+	if other.Senders > 0 {
+		pipeline.Senders = other.Senders
+	}
+	return pipeline
 }
 
 // statsdrouter config file struct
 type RouterConfig struct {
-	Rules    map[string][]StatsdNode `json:"rules"`
-	FilePath string                  `json:"-"`
+	Rules        map[string][]StatsdNode `json:"rules"`
+	BackendModes map[string]string       `json:"backend_modes,omitempty"`
+	Pipeline     *PipelineConfig         `json:"pipeline,omitempty"`
+	// chain applied to every metric before routing
+	Processors []ProcessorConfig `json:"processors,omitempty"`
+	// chains applied to metrics sent to backends of the rule
+	RuleProcessors map[string][]ProcessorConfig `json:"rule_processors,omitempty"`
+	RateLimits     []RateLimitConfig            `json:"rate_limits,omitempty"`
+	// limits of distinct metric names
+	CardinalityLimits []CardinalityLimitConfig `json:"cardinality_limits,omitempty"`
+	// pre-aggregation of metrics of rules and the master backend
+	Aggregation *AggregationsConfig `json:"aggregation,omitempty"`
+	FilePath    string              `json:"-"`
+	// guards the maps, the config is changed by API and Router methods
+	lock sync.Mutex
+}
+
+// Same as RouterConfig, but without methods, it is used to marshal the config
+type plainRouterConfig RouterConfig
+
+// Marshals the config under the lock
+func (config *RouterConfig) MarshalJSON() ([]byte, error) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return json.Marshal((*plainRouterConfig)(config))
+}
+
+// Returns number of rules in the config
+func (config *RouterConfig) RulesCount() int {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return len(config.Rules)
 }
 
 // Creates a new config struct
@@ -33,33 +134,31 @@ type RouterConfig struct {
 func NewConfig(filepath string) (*RouterConfig, error) {
 	if _, err := os.Stat(filepath); err != nil {
 		if os.IsNotExist(err) {
-			emptyConfig := RouterConfig{make(map[string][]StatsdNode), filepath}
-			data, _ := json.MarshalIndent(emptyConfig, "", "  ")
+			emptyConfig := RouterConfig{Rules: make(map[string][]StatsdNode), FilePath: filepath}
+			data, _ := json.MarshalIndent(&emptyConfig, "", "  ")
 			err = ioutil.WriteFile(filepath, data, 0644)
 			if err != nil {
-				log.Printf("Failed to write to file %s: %s", filepath, err)
-				return nil, err
+				return nil, fmt.Errorf("failed to write to file %s: %w", filepath, err)
 			}
 		}
 	}
 	fileReader, err := os.Open(filepath)
 	if err != nil {
-		log.Printf("Failed to open file %s: %s", filepath, err)
-		return nil, err
+		return nil, fmt.Errorf("failed to open file %s: %w", filepath, err)
 	}
+	defer fileReader.Close()
 	config, err := readConfigFile(fileReader)
 	if err != nil {
-		log.Printf("Failed to create new config from file %s: %s", filepath, err)
-		return nil, err
+		return nil, fmt.Errorf("failed to create new config from file %s: %w", filepath, err)
 	}
 	config.FilePath = filepath
 	return config, err
 }
 
-// Checks if StatsdNode is in []StatsdNode
+// Checks if StatsdNode with the same key is in []StatsdNode
 func nodeInSlice(node StatsdNode, list []StatsdNode) bool {
 	for _, v := range list {
-		if v == node {
+		if v.Key() == node.Key() {
 			return true
 		}
 	}
@@ -67,10 +166,25 @@ func nodeInSlice(node StatsdNode, list []StatsdNode) bool {
 }
 
 // Updates config and writes new config to the file
+// processor chains, rate and cardinality limits and aggregation of the new config replace the current ones;
+// if the file can't be written the config is left as it was
 // accepts a *RouterConfig (recieved config) as parameter
 // returns an error
 func (config *RouterConfig) UpdateConfig(newConfig *RouterConfig) error {
-	var err error
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.Rules == nil {
+		config.Rules = make(map[string][]StatsdNode)
+	}
+	// appending nodes doesn't change slices of the copied map, so a shallow copy is enough
+	previous := plainRouterConfig{
+		Rules:             maps.Clone(config.Rules),
+		Processors:        config.Processors,
+		RuleProcessors:    maps.Clone(config.RuleProcessors),
+		RateLimits:        config.RateLimits,
+		CardinalityLimits: config.CardinalityLimits,
+		Aggregation:       config.Aggregation,
+	}
 	for rule, nodes := range newConfig.Rules {
 		if _, ok := config.Rules[rule]; !ok {
 			config.Rules[rule] = nodes
@@ -82,13 +196,162 @@ func (config *RouterConfig) UpdateConfig(newConfig *RouterConfig) error {
 			}
 		}
 	}
-	jsonData, _ := json.MarshalIndent(config, "", "  ")
-	err = ioutil.WriteFile(config.FilePath, jsonData, 0644)
-	if err != nil {
-		log.Printf("Failed to write to file %s: %s", config.FilePath, err)
+	if newConfig.Processors != nil {
+		config.Processors = newConfig.Processors
+	}
+	if newConfig.RateLimits != nil {
+		config.RateLimits = newConfig.RateLimits
+	}
+	if newConfig.CardinalityLimits != nil {
+		config.CardinalityLimits = newConfig.CardinalityLimits
+	}
+	if newConfig.Aggregation != nil {
+		config.Aggregation = newConfig.Aggregation
+	}
+	for rule, processors := range newConfig.RuleProcessors {
+		if config.RuleProcessors == nil {
+			config.RuleProcessors = make(map[string][]ProcessorConfig)
+		}
+		config.RuleProcessors[rule] = processors
+	}
+	if err := config.save(); err != nil {
+		config.Rules = previous.Rules
+		config.Processors = previous.Processors
+		config.RuleProcessors = previous.RuleProcessors
+		config.RateLimits = previous.RateLimits
+		config.CardinalityLimits = previous.CardinalityLimits
+		config.Aggregation = previous.Aggregation
+		return err
+	}
+	return nil
+}
+
+// Checks that graphite nodes receive only aggregated metrics: their rules and the master
+// must be aggregated and no graphite node can be a quarantine backend, as a raw counter line
+// would overwrite the other ones of the same second in Graphite
+// accepts the master node and the update which is going to be applied, nil for the current config
+// returns an error
+func (config *RouterConfig) checkGraphiteNodes(master StatsdNode, update *RouterConfig) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	aggregation := config.Aggregation
+	cardinalityLimits := config.CardinalityLimits
+	rules := []map[string][]StatsdNode{config.Rules}
+	if update != nil {
+		if update.Aggregation != nil {
+			aggregation = update.Aggregation
+		}
+		if update.CardinalityLimits != nil {
+			cardinalityLimits = update.CardinalityLimits
+		}
+		rules = append(rules, update.Rules)
+	}
+	if aggregation == nil {
+		aggregation = &AggregationsConfig{}
+	}
+	if master.Type == BackendTypeGraphite && aggregation.Master == nil {
+		return errors.New("graphite master backend requires aggregation of master")
+	}
+	graphiteNodes := make(map[string]bool)
+	for _, ruleNodes := range rules {
+		for rule, nodes := range ruleNodes {
+			for _, node := range nodes {
+				if node.Type != BackendTypeGraphite {
+					continue
+				}
+				if _, ok := aggregation.Rules[rule]; !ok {
+					return fmt.Errorf("graphite node %s requires aggregation of rule %q", node.Key(), rule)
+				}
+				graphiteNodes[node.Key()] = true
+			}
+		}
+	}
+	for _, limit := range cardinalityLimits {
+		if limit.Backend != "" && graphiteNodes[limit.Backend] {
+			return fmt.Errorf("graphite node %s can't be a quarantine backend", limit.Backend)
+		}
+	}
+	return nil
+}
+
+// Sets backend mode and writes new config to the file
+// active mode is not stored as it is the default one; the previous mode is restored if the file
+// can't be written
+// accepts a backend key and a mode as parameters
+// returns an error
+func (config *RouterConfig) SetBackendMode(backendKey string, mode string) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	previous, stored := config.BackendModes[backendKey]
+	if mode == BackendModeActive {
+		delete(config.BackendModes, backendKey)
+	} else {
+		if config.BackendModes == nil {
+			config.BackendModes = make(map[string]string)
+		}
+		config.BackendModes[backendKey] = mode
+	}
+	if err := config.save(); err != nil {
+		if stored {
+			config.BackendModes[backendKey] = previous
+		} else {
+			delete(config.BackendModes, backendKey)
+		}
 		return err
 	}
-	return err
+	return nil
+}
+
+// Returns persisted mode of the backend, empty mode means active
+func (config *RouterConfig) BackendMode(backendKey string) string {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.BackendModes[backendKey]
+}
+
+// Removes the rule and writes new config to the file
+// accepts a rule as parameter
+// returns an error
+func (config *RouterConfig) RemoveRule(rule string) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	delete(config.Rules, rule)
+	delete(config.RuleProcessors, rule)
+	return config.save()
+}
+
+// Removes the node from the rule and writes new config to the file
+// the rule itself is kept even if it has no nodes left
+// accepts a rule and a node key as parameters
+// returns an error
+func (config *RouterConfig) RemoveNode(rule string, nodeKey string) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	nodes := config.Rules[rule][:0:0]
+	for _, node := range config.Rules[rule] {
+		if node.Key() != nodeKey {
+			nodes = append(nodes, node)
+		}
+	}
+	if _, ok := config.Rules[rule]; ok {
+		config.Rules[rule] = nodes
+	}
+	return config.save()
+}
+
+// Writes config to the file, configs without a file are kept in memory only
+// must be called with the lock held
+// returns an error
+func (config *RouterConfig) save() error {
+	if config.FilePath == "" {
+		return nil
+	}
+	jsonData, _ := json.MarshalIndent((*plainRouterConfig)(config), "", "  ")
+	err := ioutil.WriteFile(config.FilePath, jsonData, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", config.FilePath, err)
+	}
+	return nil
 }
 
 // Parses the raw json data into a RouterConfig struct
@@ -99,13 +362,11 @@ func readConfigFile(reader io.Reader) (*RouterConfig, error) {
 	var config RouterConfig
 	raw_config, err := ioutil.ReadAll(reader)
 	if err != nil {
-		log.Printf("Failed to read from io.Reader: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 	err = json.Unmarshal(raw_config, &config)
 	if err != nil {
-		log.Printf("Failed to unmarshal config file: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 	return &config, nil
 }
@@ -133,6 +394,6 @@ func NewStatsdNode(hostString string) (statsdNode StatsdNode, err error) {
 		return
 	}
 	hostManagementPort := uint16(hostManagementPort64)
-	statsdNode = StatsdNode{hostHostname, hostPort, hostManagementPort}
+	statsdNode = StatsdNode{Host: hostHostname, Port: hostPort, ManagementPort: hostManagementPort}
 	return
 }
@@ -0,0 +1,355 @@
+// Discovery of backends in DNS and target files
+package statsdrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery types
+const (
+	// SRV record, every target:port is a backend
+	DiscoveryTypeSRV = "srv"
+	// all A/AAAA records of a name, every address is a backend
+	DiscoveryTypeA = "a"
+	// JSON or YAML file with host:port:mgmt_port targets in Prometheus file_sd format
+	DiscoveryTypeFile = "file"
+)
+
+// Default intervals of refreshing discovered backends in seconds
+const (
+	DefaultDiscoveryRefreshInterval     = 30
+	DefaultFileDiscoveryRefreshInterval = 5
+)
+
+// Timeout of a single discovery lookup
+const discoveryLookupTimeout = 5 * time.Second
+
+// Time given to a removed backend to flush its send queue
+const removedBackendFlushTimeout = 5 * time.Second
+
+// Discovery settings of a node
+// other settings of the node (queue, spool, health check...) are used by all discovered backends
+type DiscoveryConfig struct {
+	// One of DiscoveryType* constants
+	Type string `json:"type"`
+	// SRV record name (e.g. _statsd._udp.example.com) or hostname
+	Name string `json:"name,omitempty"`
+	// Path of the targets file
+	Path string `json:"path,omitempty"`
+	// Interval of refreshing in seconds, 30 by default (5 for files)
+	RefreshInterval int64 `json:"refresh_interval,omitempty"`
+}
+
+// Returns what is discovered: the name or the path of the file
+func (config DiscoveryConfig) source() string {
+	if config.Type == DiscoveryTypeFile {
+		return config.Path
+	}
+	return config.Name
+}
+
+// DNS lookups used by discovery, *net.Resolver implements it
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Creates a resolver which sends queries to the DNS server
+// accepts server address in host:port format, empty address means system resolver
+func NewResolver(server string) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Checks discovery settings
+// returns an error
+func (config DiscoveryConfig) validate() error {
+	switch config.Type {
+	case DiscoveryTypeSRV, DiscoveryTypeA:
+		if config.Name == "" {
+			return errors.New("discovery name is not set")
+		}
+	case DiscoveryTypeFile:
+		if config.Path == "" {
+			return errors.New("discovery path is not set")
+		}
+	default:
+		return fmt.Errorf("unknown discovery type %q", config.Type)
+	}
+	return nil
+}
+
+// Resolves the discovery node into nodes of backends sorted by their keys
+// SRV targets use node's mgmt_port or, if it is not set, SRV port + 1;
+// addresses of A/AAAA records use node's port and mgmt_port,
+// file targets have all three parts
+func discoverNodes(ctx context.Context, resolver Resolver, node StatsdNode) ([]StatsdNode, error) {
+	template := node
+	template.Discovery = nil
+	var nodes []StatsdNode
+	switch node.Discovery.Type {
+	case DiscoveryTypeSRV:
+		_, records, err := resolver.LookupSRV(ctx, "", "", node.Discovery.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			discovered := template
+			discovered.Host = strings.TrimSuffix(record.Target, ".")
+			discovered.Port = record.Port
+			if node.ManagementPort == 0 {
+				discovered.ManagementPort = record.Port + 1
+			}
+			nodes = append(nodes, discovered)
+		}
+	case DiscoveryTypeA:
+		addresses, err := resolver.LookupHost(ctx, node.Discovery.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			discovered := template
+			discovered.Host = address
+			nodes = append(nodes, discovered)
+		}
+	case DiscoveryTypeFile:
+		targets, err := readTargetsFile(node.Discovery.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			parsed, err := NewStatsdNode(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", target, err)
+			}
+			discovered := template
+			discovered.Host = parsed.Host
+			discovered.Port = parsed.Port
+			discovered.ManagementPort = parsed.ManagementPort
+			nodes = append(nodes, discovered)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key() < nodes[j].Key() })
+	return nodes, nil
+}
+
+// Discovery of backends of one node of a rule
+type discovery struct {
+	rule     string
+	node     StatsdNode
+	interval time.Duration
+	resolver Resolver
+	// keys of backends added to the rule by this discovery
+	backends map[string]bool
+	logger   *slog.Logger
+	cancel   context.CancelFunc
+}
+
+// Starts discovery goroutine which refreshes backends of the rule right away and then periodically
+func (routingMap *RoutingMap) startDiscovery(rule string, node StatsdNode) error {
+	if err := node.Discovery.validate(); err != nil {
+		return err
+	}
+	interval := node.Discovery.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultDiscoveryRefreshInterval
+		if node.Discovery.Type == DiscoveryTypeFile {
+			interval = DefaultFileDiscoveryRefreshInterval
+		}
+	}
+	d := &discovery{
+		rule:     rule,
+		node:     node,
+		interval: time.Duration(interval) * time.Second,
+		resolver: routingMap.resolver,
+		backends: make(map[string]bool),
+		logger:   routingMap.logger.With("rule", rule, "discovery", node.Key()),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	routingMap.discoveries[rule+" "+node.Key()] = d
+	d.logger.Info("Starting backend discovery", "type", node.Discovery.Type, "source", node.Discovery.source(), "refresh_interval", interval)
+	routingMap.discoveryWG.Add(1)
+	go func() {
+		defer routingMap.discoveryWG.Done()
+		tick := time.NewTicker(d.interval)
+		defer tick.Stop()
+		for {
+			routingMap.refreshDiscovery(ctx, d)
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				d.logger.Debug("Terminating discovery goroutine")
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Resolves the discovery and adds new backends to its rule and removes gone ones
+// backends are kept when the lookup fails
+func (routingMap *RoutingMap) refreshDiscovery(ctx context.Context, d *discovery) {
+	lookupCtx, cancel := context.WithTimeout(ctx, discoveryLookupTimeout)
+	nodes, err := discoverNodes(lookupCtx, d.resolver, d.node)
+	cancel()
+	if err != nil {
+		d.logger.Warn("Failed to discover backends, keeping the current ones", "error", err)
+		return
+	}
+	// backends are created before taking the lock, creating one dials it and runs a health check
+	var newNodes []StatsdNode
+	routingMap.lock.RLock()
+	for _, node := range nodes {
+		if !d.backends[node.Key()] {
+			newNodes = append(newNodes, node)
+		}
+	}
+	routingMap.lock.RUnlock()
+	created := make(map[string]*StatsDBackend)
+	for _, node := range newNodes {
+		// backends are created one by one, so a failed one doesn't prevent adding others
+		backends, err := routingMap.createBackends([]StatsdNode{node})
+		if err != nil {
+			d.logger.Error("Failed to create discovered backend", "backend", node.Key(), "error", err)
+			continue
+		}
+		for backendKey, backend := range backends {
+			created[backendKey] = backend
+		}
+	}
+
+	var removed []*StatsDBackend
+	routingMap.lock.Lock()
+	defer func() {
+		routingMap.lock.Unlock()
+		routingMap.exitBackends(removed)
+		routingMap.exitCreatedBackends(created)
+	}()
+	// the discovery could be stopped while the lookup was running
+	if ctx.Err() != nil || routingMap.Map[d.rule] == nil {
+		return
+	}
+	found := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		backendKey := node.Key()
+		found[backendKey] = true
+		if d.backends[backendKey] {
+			continue
+		}
+		// a backend listed in the rule or added by another discovery is not owned by this one,
+		// so it is not removed from the rule when this discovery doesn't find it anymore
+		if backend := routingMap.backendList[backendKey]; backend != nil && backendInSlice(backend, routingMap.Map[d.rule].Backends) {
+			continue
+		}
+		if routingMap.backendList[backendKey] == nil && created[backendKey] == nil {
+			// creating it failed, it is retried on the next refresh
+			continue
+		}
+		if err := routingMap.addBackendToRule(d.rule, node, created); err != nil {
+			d.logger.Error("Failed to add discovered backend", "backend", backendKey, "error", err)
+			continue
+		}
+		d.backends[backendKey] = true
+		d.logger.Info("Discovered backend added to rule", "backend", backendKey)
+	}
+	for backendKey := range d.backends {
+		if found[backendKey] {
+			continue
+		}
+		delete(d.backends, backendKey)
+		d.logger.Info("Discovered backend removed from rule", "backend", backendKey)
+		if backend := routingMap.removeBackendFromRule(d.rule, backendKey); backend != nil {
+			removed = append(removed, backend)
+		}
+	}
+}
+
+// Removes the backend from the rule and, if no other rule references it, from the routing map
+// must be called with the lock held
+// returns the backend if it was removed from the routing map and has to be shut down
+func (routingMap *RoutingMap) removeBackendFromRule(rule string, backendKey string) *StatsDBackend {
+	backend := routingMap.backendList[backendKey]
+	routingRule := routingMap.Map[rule]
+	if backend == nil || routingRule == nil {
+		return nil
+	}
+	backends := routingRule.Backends[:0:0]
+	for _, v := range routingRule.Backends {
+		if v != backend {
+			backends = append(backends, v)
+		}
+	}
+	routingRule.Backends = backends
+	for _, other := range routingMap.Map {
+		if backendInSlice(backend, other.Backends) {
+			return nil
+		}
+	}
+	delete(routingMap.backendList, backendKey)
+	return backend
+}
+
+// Stops the discovery and removes backends it has added from its rule
+// must be called with the lock held
+// returns backends which were removed from the routing map and have to be shut down
+func (routingMap *RoutingMap) stopDiscovery(key string) []*StatsDBackend {
+	d := routingMap.discoveries[key]
+	if d == nil {
+		return nil
+	}
+	d.cancel()
+	delete(routingMap.discoveries, key)
+	d.logger.Info("Stopped backend discovery")
+	var removed []*StatsDBackend
+	for backendKey := range d.backends {
+		if backend := routingMap.removeBackendFromRule(d.rule, backendKey); backend != nil {
+			removed = append(removed, backend)
+		}
+	}
+	return removed
+}
+
+// Shuts down backends which were removed from the routing map
+func (routingMap *RoutingMap) exitBackends(backends []*StatsDBackend) {
+	ctx, cancel := context.WithTimeout(context.Background(), removedBackendFlushTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend *StatsDBackend) {
+			defer wg.Done()
+			if err := backend.Close(ctx); err != nil {
+				routingMap.logger.Warn("Failed to close removed backend", "backend", backend.Key(), "error", err)
+			}
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// Stops all discoveries of the routing map
+func (routingMap *RoutingMap) Close() {
+	routingMap.lock.Lock()
+	for key, d := range routingMap.discoveries {
+		d.cancel()
+		delete(routingMap.discoveries, key)
+	}
+	routingMap.lock.Unlock()
+	routingMap.discoveryWG.Wait()
+}
@@ -0,0 +1,226 @@
+package statsdrouter
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Resolver with records changed by the test
+type stubResolver struct {
+	lock  sync.Mutex
+	srv   []*net.SRV
+	hosts []string
+	err   error
+}
+
+func (resolver *stubResolver) set(srv []*net.SRV, hosts []string) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	resolver.srv = srv
+	resolver.hosts = hosts
+}
+
+func (resolver *stubResolver) fail(err error) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	resolver.err = err
+}
+
+func (resolver *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	return name, append([]*net.SRV(nil), resolver.srv...), resolver.err
+}
+
+func (resolver *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	return append([]string(nil), resolver.hosts...), resolver.err
+}
+
+// Creates a routing map with the discovery node and listed nodes in rule "^test\."
+// the discovery refreshes only when the test calls refresh
+func newDiscoveryRoutingMap(t *testing.T, resolver Resolver, node StatsdNode, listed ...StatsdNode) (*RoutingMap, func()) {
+	t.Helper()
+	logging, err := NewLogging(io.Discard, LogFormatLogfmt, slog.LevelError)
+	if err != nil {
+		t.Fatalf("NewLogging failed: %v", err)
+	}
+	options := BackendOptions{
+		CheckInterval:          3600,
+		UnhealthyCheckInterval: 3600,
+		Rise:                   DefaultHealthCheckRise,
+		Fall:                   DefaultHealthCheckFall,
+		QueueSize:              16,
+		Senders:                1,
+		OverflowPolicy:         OverflowPolicyDropNewest,
+		Resolver:               resolver,
+	}
+	node.HealthCheck = &HealthCheckConfig{Type: HealthCheckNone}
+	node.Discovery.RefreshInterval = 3600
+	routingMap := NewRoutingMap(options, logging)
+	config := &RouterConfig{Rules: map[string][]StatsdNode{`^test\.`: append(withoutHealthCheck(listed), node)}}
+	if err := routingMap.UpdateRoutingMap(config); err != nil {
+		t.Fatalf("UpdateRoutingMap failed: %v", err)
+	}
+	t.Cleanup(func() {
+		routingMap.Close()
+		routingMap.exitBackends(routingMap.Backends())
+	})
+	refresh := func() {
+		routingMap.lock.RLock()
+		d := routingMap.discoveries[`^test\. `+node.Key()]
+		routingMap.lock.RUnlock()
+		routingMap.refreshDiscovery(context.Background(), d)
+	}
+	return routingMap, refresh
+}
+
+// Returns copies of the nodes without health checks
+func withoutHealthCheck(nodes []StatsdNode) []StatsdNode {
+	result := make([]StatsdNode, 0, len(nodes))
+	for _, node := range nodes {
+		node.HealthCheck = &HealthCheckConfig{Type: HealthCheckNone}
+		result = append(result, node)
+	}
+	return result
+}
+
+func ruleBackendKeys(routingMap *RoutingMap, rule string) []string {
+	keys := []string{}
+	for _, backend := range routingMap.RuleBackends(rule) {
+		keys = append(keys, backend.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDiscoverySRVAddsAndRemovesBackends(t *testing.T) {
+	resolver := &stubResolver{}
+	node := StatsdNode{Discovery: &DiscoveryConfig{Type: DiscoveryTypeSRV, Name: "_statsd._udp.example.com"}}
+	routingMap, refresh := newDiscoveryRoutingMap(t, resolver, node)
+
+	steps := []struct {
+		srv  []*net.SRV
+		want []string
+	}{
+		{
+			srv:  []*net.SRV{{Target: "127.0.0.1.", Port: 18001}},
+			want: []string{"127.0.0.1:18001:18002"},
+		},
+		{
+			srv:  []*net.SRV{{Target: "127.0.0.1.", Port: 18001}, {Target: "127.0.0.1.", Port: 18011}},
+			want: []string{"127.0.0.1:18001:18002", "127.0.0.1:18011:18012"},
+		},
+		{
+			srv:  []*net.SRV{{Target: "127.0.0.1.", Port: 18011}},
+			want: []string{"127.0.0.1:18011:18012"},
+		},
+		{
+			srv:  nil,
+			want: []string{},
+		},
+	}
+	for i, step := range steps {
+		resolver.set(step.srv, nil)
+		refresh()
+		if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("step %d: rule backends %v, want %v", i, got, step.want)
+		}
+		if got := len(routingMap.Backends()); got != len(step.want) {
+			t.Fatalf("step %d: %d backends in routing map, want %d", i, got, len(step.want))
+		}
+	}
+}
+
+func TestDiscoveryAAddsAndRemovesBackends(t *testing.T) {
+	resolver := &stubResolver{}
+	node := StatsdNode{Port: 18125, ManagementPort: 18126, Discovery: &DiscoveryConfig{Type: DiscoveryTypeA, Name: "statsd.example.com"}}
+	routingMap, refresh := newDiscoveryRoutingMap(t, resolver, node)
+
+	steps := []struct {
+		hosts []string
+		want  []string
+	}{
+		{
+			hosts: []string{"127.0.0.1"},
+			want:  []string{"127.0.0.1:18125:18126"},
+		},
+		{
+			hosts: []string{"127.0.0.2", "127.0.0.1"},
+			want:  []string{"127.0.0.1:18125:18126", "127.0.0.2:18125:18126"},
+		},
+		{
+			hosts: []string{"127.0.0.2"},
+			want:  []string{"127.0.0.2:18125:18126"},
+		},
+	}
+	for i, step := range steps {
+		resolver.set(nil, step.hosts)
+		refresh()
+		if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("step %d: rule backends %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestDiscoveryKeepsBackendsOnLookupError(t *testing.T) {
+	resolver := &stubResolver{}
+	node := StatsdNode{Port: 18125, ManagementPort: 18126, Discovery: &DiscoveryConfig{Type: DiscoveryTypeA, Name: "statsd.example.com"}}
+	routingMap, refresh := newDiscoveryRoutingMap(t, resolver, node)
+
+	resolver.set(nil, []string{"127.0.0.1"})
+	refresh()
+	resolver.fail(&net.DNSError{Err: "server misbehaving", Name: "statsd.example.com"})
+	refresh()
+	want := []string{"127.0.0.1:18125:18126"}
+	if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rule backends %v, want %v", got, want)
+	}
+}
+
+func TestDiscoveryKeepsListedBackends(t *testing.T) {
+	resolver := &stubResolver{}
+	node := StatsdNode{Discovery: &DiscoveryConfig{Type: DiscoveryTypeSRV, Name: "_statsd._udp.example.com"}}
+	listed := StatsdNode{Host: "127.0.0.1", Port: 18001, ManagementPort: 18002}
+	routingMap, refresh := newDiscoveryRoutingMap(t, resolver, node, listed)
+
+	resolver.set([]*net.SRV{{Target: "127.0.0.1.", Port: 18001}, {Target: "127.0.0.1.", Port: 18011}}, nil)
+	refresh()
+	want := []string{"127.0.0.1:18001:18002", "127.0.0.1:18011:18012"}
+	if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rule backends %v, want %v", got, want)
+	}
+	resolver.set(nil, nil)
+	refresh()
+	want = []string{"127.0.0.1:18001:18002"}
+	if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed backend is removed with discovered ones: rule backends %v, want %v", got, want)
+	}
+}
+
+func TestDiscoveryReleasesBackendListedLater(t *testing.T) {
+	resolver := &stubResolver{}
+	node := StatsdNode{Discovery: &DiscoveryConfig{Type: DiscoveryTypeSRV, Name: "_statsd._udp.example.com"}}
+	routingMap, refresh := newDiscoveryRoutingMap(t, resolver, node)
+
+	resolver.set([]*net.SRV{{Target: "127.0.0.1.", Port: 18001}}, nil)
+	refresh()
+	listed := StatsdNode{Host: "127.0.0.1", Port: 18001, ManagementPort: 18002}
+	config := &RouterConfig{Rules: map[string][]StatsdNode{`^test\.`: withoutHealthCheck([]StatsdNode{listed})}}
+	if err := routingMap.UpdateRoutingMap(config); err != nil {
+		t.Fatalf("UpdateRoutingMap failed: %v", err)
+	}
+	resolver.set(nil, nil)
+	refresh()
+	want := []string{"127.0.0.1:18001:18002"}
+	if got := ruleBackendKeys(routingMap, `^test\.`); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rule backends %v, want %v", got, want)
+	}
+}
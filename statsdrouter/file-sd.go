@@ -0,0 +1,116 @@
+// Target files of file-based discovery
+package statsdrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Group of targets in Prometheus file_sd format, labels are ignored
+type targetGroup struct {
+	Targets []string `json:"targets"`
+}
+
+// Reads host:port:mgmt_port targets from a JSON or YAML (.yml, .yaml) file
+// returns targets of all groups and an error
+func readTargetsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []targetGroup
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		groups, err = parseTargetsYAML(string(data))
+	default:
+		err = json.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse targets file %s: %w", path, err)
+	}
+	var targets []string
+	for _, group := range groups {
+		targets = append(targets, group.Targets...)
+	}
+	return targets, nil
+}
+
+// Parses the subset of YAML used by file_sd files:
+// a list of groups with "targets" as a block or flow sequence of scalars
+//
+//	# targets.yml
+//	- targets:
+//	    - host1:8125:8126
+//	  labels:
+//	    env: prod
+//	- targets: ['host2:8125:8126', "host3:8125:8126"]
+//
+// other keys and their nested values are skipped
+func parseTargetsYAML(data string) ([]targetGroup, error) {
+	var groups []targetGroup
+	inTargets := false
+	targetsIndent := 0
+	for number, line := range strings.Split(data, "\n") {
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if indent == 0 {
+			if !strings.HasPrefix(trimmed, "-") {
+				return nil, fmt.Errorf("line %d: expected list of target groups", number+1)
+			}
+			groups = append(groups, targetGroup{})
+			inTargets = false
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if trimmed == "" {
+				continue
+			}
+			indent = len(line) - len(strings.TrimLeft(strings.TrimPrefix(strings.TrimLeft(line, " "), "-"), " "))
+		}
+		if len(groups) == 0 {
+			return nil, fmt.Errorf("line %d: expected list of target groups", number+1)
+		}
+		group := &groups[len(groups)-1]
+		if inTargets && indent >= targetsIndent && strings.HasPrefix(trimmed, "-") {
+			group.Targets = append(group.Targets, yamlScalar(strings.TrimPrefix(trimmed, "-")))
+			continue
+		}
+		inTargets = false
+		key, value, found := strings.Cut(trimmed, ":")
+		if !found || key != "targets" {
+			// another key of the group or a nested value
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			inTargets = true
+			targetsIndent = indent
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			for _, target := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if target = yamlScalar(target); target != "" {
+					group.Targets = append(group.Targets, target)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("line %d: targets must be a list", number+1)
+		}
+	}
+	return groups, nil
+}
+
+// Strips spaces and quotes of a YAML scalar
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return value
+}
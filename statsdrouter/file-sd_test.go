@@ -0,0 +1,127 @@
+package statsdrouter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetsYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []targetGroup
+		wantErr bool
+	}{
+		{
+			name: "example of doc comment",
+			data: "# targets.yml\n- targets:\n    - host1:8125:8126\n  labels:\n    env: prod\n" +
+				"- targets: ['host2:8125:8126', \"host3:8125:8126\"]\n",
+			want: []targetGroup{
+				{Targets: []string{"host1:8125:8126"}},
+				{Targets: []string{"host2:8125:8126", "host3:8125:8126"}},
+			},
+		},
+		{
+			name: "block list",
+			data: "- targets:\n  - host1:8125:8126\n  - host2:8125:8126\n",
+			want: []targetGroup{{Targets: []string{"host1:8125:8126", "host2:8125:8126"}}},
+		},
+		{
+			name: "block list indented deeper than key",
+			data: "- targets:\n    - host1:8125:8126\n    - 'host2:8125:8126'\n",
+			want: []targetGroup{{Targets: []string{"host1:8125:8126", "host2:8125:8126"}}},
+		},
+		{
+			name: "flow list with quotes",
+			data: "- targets: ['host1:8125:8126', \"host2:8125:8126\", host3:8125:8126]\n",
+			want: []targetGroup{{Targets: []string{"host1:8125:8126", "host2:8125:8126", "host3:8125:8126"}}},
+		},
+		{
+			name: "labels are skipped",
+			data: "- targets:\n    - host1:8125:8126\n  labels:\n    env: prod\n    - not-a-target\n" +
+				"- labels:\n    env: dev\n  targets: [host2:8125:8126]\n",
+			want: []targetGroup{
+				{Targets: []string{"host1:8125:8126"}},
+				{Targets: []string{"host2:8125:8126"}},
+			},
+		},
+		{
+			name: "comments and document start",
+			data: "---\n# backends\n- targets: # statsd nodes\n  # first one\n  - host1:8125:8126 # primary\n\n  - host2:8125:8126\n",
+			want: []targetGroup{{Targets: []string{"host1:8125:8126", "host2:8125:8126"}}},
+		},
+		{
+			name: "group on separate line",
+			data: "-\n  targets:\n    - host1:8125:8126\n",
+			want: []targetGroup{{Targets: []string{"host1:8125:8126"}}},
+		},
+		{
+			name: "empty file",
+			data: "# nothing here\n",
+			want: nil,
+		},
+		{
+			name:    "mapping instead of list",
+			data:    "targets:\n  - host1:8125:8126\n",
+			wantErr: true,
+		},
+		{
+			name:    "targets is a scalar",
+			data:    "- targets: host1:8125:8126\n",
+			wantErr: true,
+		},
+		{
+			name:    "indented line before first group",
+			data:    "  - targets: [host1:8125:8126]\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups, err := parseTargetsYAML(test.data)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", groups)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTargetsYAML failed: %v", err)
+			}
+			if !reflect.DeepEqual(groups, test.want) {
+				t.Fatalf("got %v, want %v", groups, test.want)
+			}
+		})
+	}
+}
+
+func TestReadTargetsFile(t *testing.T) {
+	directory := t.TempDir()
+	files := map[string]string{
+		"targets.json": `[{"targets": ["host1:8125:8126"], "labels": {"env": "prod"}}, {"targets": ["host2:8125:8126"]}]`,
+		"targets.yml":  "- targets:\n  - host1:8125:8126\n- targets: [host2:8125:8126]\n",
+		"broken.json":  `{"targets": ["host1:8125:8126"]}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"host1:8125:8126", "host2:8125:8126"}
+	for _, name := range []string{"targets.json", "targets.yml"} {
+		targets, err := readTargetsFile(filepath.Join(directory, name))
+		if err != nil {
+			t.Fatalf("%s: readTargetsFile failed: %v", name, err)
+		}
+		if !reflect.DeepEqual(targets, want) {
+			t.Fatalf("%s: got %v, want %v", name, targets, want)
+		}
+	}
+	for _, name := range []string{"broken.json", "missing.json"} {
+		if _, err := readTargetsFile(filepath.Join(directory, name)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Graphite plaintext protocol backend
+package statsdrouter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default settings of graphite backends
+const (
+	DefaultGraphiteBatchSize = 500
+	// seconds
+	DefaultGraphiteFlushInterval = 1
+	DefaultGraphiteTimeout       = 5
+)
+
+// Settings of a graphite backend
+type GraphiteConfig struct {
+	// Prepended to metric names with a dot
+	Prefix string `json:"prefix,omitempty"`
+	// Max number of lines written at once, 500 by default
+	BatchSize int `json:"batch_size,omitempty"`
+	// Max time a line waits for its batch in seconds, 1 by default
+	FlushInterval int64 `json:"flush_interval,omitempty"`
+	// Timeout of connecting and writing in seconds, 5 by default
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// Checks settings and fills defaults
+// returns settings and an error
+func (config GraphiteConfig) normalize() (GraphiteConfig, error) {
+	if config.BatchSize < 0 || config.FlushInterval < 0 || config.Timeout < 0 {
+		return config, errors.New("batch_size, flush_interval and timeout can't be negative")
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultGraphiteBatchSize
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultGraphiteFlushInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultGraphiteTimeout
+	}
+	config.Prefix = strings.TrimSuffix(config.Prefix, ".")
+	return config, nil
+}
+
+// Replaces characters which break Graphite plaintext lines and tags
+var graphiteReplacer = strings.NewReplacer(" ", "_", "\t", "_", ";", "_", "=", "_")
+
+// Writes batches of lines in Graphite plaintext protocol to a Carbon endpoint over TCP
+type graphiteWriter struct {
+	address string
+	config  GraphiteConfig
+	conn    net.Conn
+	logger  *slog.Logger
+}
+
+// Creates a new graphiteWriter struct, it connects on the first write
+// accepts the address, graphite settings and logger as parameters
+// returns the *graphiteWriter struct
+func newGraphiteWriter(address string, config GraphiteConfig, logger *slog.Logger) *graphiteWriter {
+	return &graphiteWriter{address: address, config: config, logger: logger}
+}
+
+// Formats a metric as a "name value timestamp" line
+// only counters and absolute gauges are accepted, timers, sets and relative gauges can't be
+// represented by one value; graphite nodes are allowed only in aggregated rules or as
+// aggregated master (see checkGraphiteNodes), so a counter is the sum of a flush window
+// divided by its sample rate, not a single increment
+// DogStatsD key:value tags become Graphite tags, tags without value are skipped
+// returns the buffer with the line appended and false if the metric is not accepted
+func (writer *graphiteWriter) format(buffer []byte, metric *StatsDMetric, now time.Time) ([]byte, bool) {
+	var value float64
+	switch metric.metricType {
+	case "c":
+		value = metric.value / metric.SampleRate()
+	case "g":
+		if strings.HasPrefix(metric.valueText, "+") || strings.HasPrefix(metric.valueText, "-") {
+			return buffer, false
+		}
+		value = metric.value
+	default:
+		return buffer, false
+	}
+	if writer.config.Prefix != "" {
+		buffer = append(buffer, writer.config.Prefix...)
+		buffer = append(buffer, '.')
+	}
+	buffer = append(buffer, graphiteReplacer.Replace(metric.name)...)
+	for _, tag := range metric.tags {
+		key, tagValue, ok := strings.Cut(tag, ":")
+		if !ok || key == "" || tagValue == "" {
+			continue
+		}
+		buffer = append(buffer, ';')
+		buffer = append(buffer, graphiteReplacer.Replace(key)...)
+		buffer = append(buffer, '=')
+		buffer = append(buffer, graphiteReplacer.Replace(tagValue)...)
+	}
+	buffer = append(buffer, ' ')
+	buffer = strconv.AppendFloat(buffer, value, 'f', -1, 64)
+	buffer = append(buffer, ' ')
+	buffer = strconv.AppendInt(buffer, now.Unix(), 10)
+	buffer = append(buffer, '\n')
+	return buffer, true
+}
+
+// Writes a batch, connecting first if there is no connection
+// the connection is closed on errors so the next write reconnects
+// returns an error
+func (writer *graphiteWriter) write(batch []byte) error {
+	timeout := time.Duration(writer.config.Timeout) * time.Second
+	// a write to a connection closed by Carbon succeeds and its data is lost,
+	// so the connection is checked first; Carbon never sends anything, any read result but timeout means it is gone
+	if writer.conn != nil {
+		writer.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		var probe [1]byte
+		if _, err := writer.conn.Read(probe[:]); !errors.Is(err, os.ErrDeadlineExceeded) {
+			writer.logger.Debug("Carbon closed the connection, reconnecting", "error", err)
+			writer.close()
+		}
+	}
+	if writer.conn == nil {
+		conn, err := net.DialTimeout("tcp", writer.address, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		writer.logger.Debug("Connected to Carbon", "address", conn.RemoteAddr().String())
+		writer.conn = conn
+	}
+	writer.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := writer.conn.Write(batch); err != nil {
+		writer.close()
+		return err
+	}
+	return nil
+}
+
+// Closes the connection
+func (writer *graphiteWriter) close() {
+	if writer.conn != nil {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+}
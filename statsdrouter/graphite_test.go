@@ -0,0 +1,105 @@
+package statsdrouter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGraphiteFormat(t *testing.T) {
+	writer := newGraphiteWriter("127.0.0.1:2003", GraphiteConfig{Prefix: "stats"}, discardLogger)
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"app.hits:3|c", "stats.app.hits 3 1700000000\n"},
+		{"app.hits:3|c|@0.5", "stats.app.hits 6 1700000000\n"},
+		{"app.temp:21.5|g", "stats.app.temp 21.5 1700000000\n"},
+		{"app.hits:1|c|#env:prod,canary,dc:eu 1", "stats.app.hits;env=prod;dc=eu_1 1 1700000000\n"},
+		{"app.my hits:1|c", "stats.app.my_hits 1 1700000000\n"},
+		// not representable by one value
+		{"app.temp:+2|g", ""},
+		{"app.temp:-2|g", ""},
+		{"app.latency:12|ms", ""},
+		{"app.users:alice|s", ""},
+	}
+	for _, test := range tests {
+		metric, err := parseMetric(test.line)
+		if err != nil {
+			t.Fatalf("parseMetric(%q) failed: %v", test.line, err)
+		}
+		buffer, accepted := writer.format(nil, metric, now)
+		if accepted != (test.want != "") || string(buffer) != test.want {
+			t.Errorf("format(%q) = %q, %v, want %q", test.line, buffer, accepted, test.want)
+		}
+	}
+}
+
+func TestCheckGraphiteNodesRequiresAggregation(t *testing.T) {
+	graphite := StatsdNode{Host: "127.0.0.1", Port: 2003, Type: BackendTypeGraphite}
+	statsd := StatsdNode{Host: "127.0.0.1", Port: 8125, ManagementPort: 8126}
+	aggregated := &AggregationsConfig{Rules: map[string]AggregationConfig{`^app\.`: {}}}
+	tests := []struct {
+		name    string
+		master  StatsdNode
+		config  *RouterConfig
+		update  *RouterConfig
+		wantErr bool
+	}{
+		{
+			name:   "aggregated rule",
+			master: statsd,
+			config: &RouterConfig{Rules: map[string][]StatsdNode{`^app\.`: {graphite}}, Aggregation: aggregated},
+		},
+		{
+			name:    "rule without aggregation",
+			master:  statsd,
+			config:  &RouterConfig{Rules: map[string][]StatsdNode{`^db\.`: {graphite}}, Aggregation: aggregated},
+			wantErr: true,
+		},
+		{
+			name:    "graphite master without aggregation",
+			master:  graphite,
+			config:  &RouterConfig{},
+			wantErr: true,
+		},
+		{
+			name:   "aggregated graphite master",
+			master: graphite,
+			config: &RouterConfig{Aggregation: &AggregationsConfig{Master: &AggregationConfig{}}},
+		},
+		{
+			name:    "quarantine backend",
+			master:  statsd,
+			config:  &RouterConfig{Rules: map[string][]StatsdNode{`^app\.`: {graphite}}, Aggregation: aggregated},
+			update:  &RouterConfig{CardinalityLimits: []CardinalityLimitConfig{{Prefix: "app.", Backend: graphite.Key()}}},
+			wantErr: true,
+		},
+		{
+			name:    "added to rule without aggregation",
+			master:  statsd,
+			config:  &RouterConfig{Aggregation: aggregated},
+			update:  &RouterConfig{Rules: map[string][]StatsdNode{`^db\.`: {graphite}}},
+			wantErr: true,
+		},
+		{
+			name:    "update removes aggregation of its rule",
+			master:  statsd,
+			config:  &RouterConfig{Rules: map[string][]StatsdNode{`^app\.`: {graphite}}, Aggregation: aggregated},
+			update:  &RouterConfig{Aggregation: &AggregationsConfig{}},
+			wantErr: true,
+		},
+		{
+			name:   "update adds aggregation with the node",
+			master: statsd,
+			config: &RouterConfig{},
+			update: &RouterConfig{Rules: map[string][]StatsdNode{`^app\.`: {graphite}}, Aggregation: aggregated},
+		},
+	}
+	for _, test := range tests {
+		err := test.config.checkGraphiteNodes(test.master, test.update)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
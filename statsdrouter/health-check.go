@@ -0,0 +1,308 @@
+// Health check strategies of backends
+package statsdrouter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Health check types
+const (
+	// statsd admin interface "health" command on the management port
+	HealthCheckStatsd = "statsd"
+	// plain TCP connect
+	HealthCheckTCP = "tcp"
+	// HTTP GET with expected status
+	HealthCheckHTTP = "http"
+	// backend is always up
+	HealthCheckNone = "none"
+)
+
+// Health check defaults
+const (
+	// Number of consecutive successful checks to mark a down backend up
+	DefaultHealthCheckRise = 2
+	// Number of consecutive failed checks to mark an up backend down
+	DefaultHealthCheckFall = 3
+	// Timeout of a single health check probe
+	defaultHealthCheckTimeout = 2 * time.Second
+	// Max deviation of a check interval as a fraction of it
+	healthCheckJitter = 0.1
+)
+
+// Health check settings of a node
+type HealthCheckConfig struct {
+	// One of HealthCheck* constants, the default of the node type when empty:
+	// statsd for statsd nodes, tcp for graphite, none for influx over UDP and http for influx over HTTP
+	Type string `json:"type"`
+	// Port for statsd and tcp checks, node's mgmt_port by default
+	Port uint16 `json:"port,omitempty"`
+	// URL for http check
+	URL string `json:"url,omitempty"`
+	// Expected HTTP status for http check, 200 by default
+	ExpectedStatus int `json:"expected_status,omitempty"`
+	// Timeout of a probe in seconds, 2 by default
+	Timeout int64 `json:"timeout,omitempty"`
+	// Rise and fall thresholds, global ones by default
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+}
+
+// Health check strategy
+type HealthChecker interface {
+	// Checks backend, returns true if it is up
+	Check() bool
+	// Releases resources of the checker
+	Close()
+}
+
+// Creates a health checker for the node according to its health_check settings
+// returns the HealthChecker and an error
+func NewHealthChecker(node StatsdNode, logger *slog.Logger) (HealthChecker, error) {
+	config := HealthCheckConfig{Type: HealthCheckStatsd}
+	// backends which don't speak StatsD have no admin interface, they are checked on their port
+	defaultPort := node.ManagementPort
+	switch node.Type {
+	case BackendTypeGraphite:
+		config.Type = HealthCheckTCP
+		defaultPort = node.Port
+	case BackendTypeInflux:
+		// there is nothing to check over UDP
+		config.Type = HealthCheckNone
+		if node.Influx != nil && node.Influx.Protocol == InfluxProtocolHTTP {
+			influx, err := node.Influx.normalize(node)
+			if err != nil {
+				return nil, err
+			}
+			config = HealthCheckConfig{Type: HealthCheckHTTP, URL: influx.pingURL(), ExpectedStatus: http.StatusNoContent}
+		}
+		defaultPort = node.Port
+	}
+	if override := node.HealthCheck; override != nil {
+		// set fields replace the defaults of the node type, settings of the default check
+		// don't apply to a check of another type; rise and fall are applied by BackendOptions.forNode
+		if override.Type != "" && override.Type != config.Type {
+			config = HealthCheckConfig{Type: override.Type}
+		}
+		if override.Port != 0 {
+			config.Port = override.Port
+		}
+		if override.URL != "" {
+			config.URL = override.URL
+		}
+		if override.ExpectedStatus != 0 {
+			config.ExpectedStatus = override.ExpectedStatus
+		}
+		if override.Timeout != 0 {
+			config.Timeout = override.Timeout
+		}
+	}
+	if config.Port == 0 {
+		config.Port = defaultPort
+	}
+	timeout := defaultHealthCheckTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	switch config.Type {
+	case HealthCheckStatsd, "":
+		checker := &statsdHealthChecker{host: node.Host, port: config.Port, timeout: timeout, logger: logger}
+		if err := checker.open(); err != nil {
+			return nil, err
+		}
+		return checker, nil
+	case HealthCheckTCP:
+		return &tcpHealthChecker{address: net.JoinHostPort(node.Host, fmt.Sprint(config.Port)), timeout: timeout, logger: logger}, nil
+	case HealthCheckHTTP:
+		if config.URL == "" {
+			return nil, errors.New("url of http health check is not set")
+		}
+		if config.ExpectedStatus == 0 {
+			config.ExpectedStatus = http.StatusOK
+		}
+		return &httpHealthChecker{url: config.URL, expectedStatus: config.ExpectedStatus, client: &http.Client{Timeout: timeout}, logger: logger}, nil
+	case HealthCheckNone:
+		return noneHealthChecker{}, nil
+	default:
+		return nil, fmt.Errorf("unknown health check type %q", config.Type)
+	}
+}
+
+// Health checker which speaks statsd admin protocol
+type statsdHealthChecker struct {
+	host    string
+	port    uint16
+	timeout time.Duration
+	conn    net.Conn
+	logger  *slog.Logger
+}
+
+// Opens TCP connection to the management port
+func (checker *statsdHealthChecker) open() error {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", checker.host, checker.port))
+	if err != nil {
+		checker.logger.Error("Error resolving TCP address", "host", checker.host, "port", checker.port, "error", err)
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr.String(), checker.timeout)
+	handled := false
+	if err != nil {
+		checker.logger.Warn("Error dial to TCP address", "address", addr.String(), "error", err)
+		// TODO: add *net.timeoutError handling
+		if opErr, ok := err.(*net.OpError); ok {
+			if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+				if sysErr.Err == syscall.ECONNREFUSED {
+					handled = true
+					checker.logger.Debug("Got ECONNREFUSED")
+				}
+			}
+		}
+		if !handled {
+			return err
+		}
+	}
+	if handled {
+		checker.conn = nil
+	} else {
+		checker.conn = conn
+	}
+	return nil
+}
+
+// Checks aliveness of backend with "health" admin command
+// Function tries to reconnect to management port 'retryCount' times
+// returns false or true
+func (checker *statsdHealthChecker) Check() bool {
+	var err error
+	var retryCount = 0
+	checker.logger.Debug("Checking backend")
+	statusString := []byte("health")
+	// TODO: don't make last checker.open call if we already exceeded retryCount
+Retry:
+	if retryCount > 1 {
+		checker.logger.Warn("Giving up health check", "attempts", retryCount)
+		return false
+	}
+	if checker.conn == nil {
+		err = checker.open()
+		if err != nil || checker.conn == nil {
+			if err != nil {
+				checker.logger.Warn("Failed to open management connection", "error", err)
+			} else {
+				checker.logger.Warn("Failed to open management connection: the connection is still not initialized")
+			}
+			retryCount++
+			checker.logger.Debug("Retrying health check", "retry", retryCount)
+			goto Retry
+		}
+	}
+	checker.conn.SetWriteDeadline(time.Now().Add(checker.timeout))
+	_, err = checker.conn.Write(statusString)
+	if err != nil {
+		checker.logger.Warn("Write to management connection failed", "error", err)
+		retryCount++
+		checker.logger.Debug("Retrying health check", "retry", retryCount)
+		err = checker.open()
+		if err != nil {
+			checker.logger.Warn("Failed to open management connection", "error", err)
+			return false
+		}
+		goto Retry
+	}
+	reply := make([]byte, 1024)
+
+	checker.conn.SetReadDeadline(time.Now().Add(checker.timeout))
+	_, err = checker.conn.Read(reply)
+	if err != nil {
+		checker.logger.Warn("Read from management connection failed", "error", err)
+		retryCount++
+		checker.logger.Debug("Retrying health check", "retry", retryCount)
+		err = checker.open()
+		if err != nil {
+			checker.logger.Warn("Failed to open management connection", "error", err)
+			return false
+		}
+		goto Retry
+	}
+	healthStatus := strings.Trim(string(reply), "\x00")
+
+	checker.logger.Debug("Response from backend", "response", healthStatus)
+	if strings.Contains(healthStatus, "up") {
+		checker.logger.Debug("Backend is up")
+		return true
+	} else {
+		checker.logger.Debug("Backend is down")
+		return false
+	}
+}
+
+// Closes the management connection
+func (checker *statsdHealthChecker) Close() {
+	if checker.conn != nil {
+		checker.conn.Close()
+	}
+}
+
+// Health checker which only connects to a TCP port
+type tcpHealthChecker struct {
+	address string
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+// Checks that TCP connection can be established
+func (checker *tcpHealthChecker) Check() bool {
+	conn, err := net.DialTimeout("tcp", checker.address, checker.timeout)
+	if err != nil {
+		checker.logger.Debug("Backend is down", "address", checker.address, "error", err)
+		return false
+	}
+	conn.Close()
+	checker.logger.Debug("Backend is up", "address", checker.address)
+	return true
+}
+
+func (checker *tcpHealthChecker) Close() {}
+
+// Health checker which makes HTTP GET requests
+type httpHealthChecker struct {
+	url            string
+	expectedStatus int
+	client         *http.Client
+	logger         *slog.Logger
+}
+
+// Checks that HTTP GET returns expected status
+func (checker *httpHealthChecker) Check() bool {
+	response, err := checker.client.Get(checker.url)
+	if err != nil {
+		checker.logger.Debug("Backend is down", "url", checker.url, "error", err)
+		return false
+	}
+	response.Body.Close()
+	if response.StatusCode != checker.expectedStatus {
+		checker.logger.Debug("Backend is down", "url", checker.url, "status", response.StatusCode)
+		return false
+	}
+	checker.logger.Debug("Backend is up", "url", checker.url)
+	return true
+}
+
+func (checker *httpHealthChecker) Close() {
+	checker.client.CloseIdleConnections()
+}
+
+// Health checker for backends which can't be checked, they are always up
+type noneHealthChecker struct{}
+
+func (noneHealthChecker) Check() bool { return true }
+
+func (noneHealthChecker) Close() {}
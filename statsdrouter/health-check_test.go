@@ -0,0 +1,93 @@
+package statsdrouter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHealthCheckerMergesNodeSettings(t *testing.T) {
+	influxHTTP := &InfluxConfig{Protocol: InfluxProtocolHTTP}
+	tests := []struct {
+		name string
+		node StatsdNode
+		// address of tcp checks, url of http checks
+		want           string
+		wantType       string
+		expectedStatus int
+		timeout        time.Duration
+	}{
+		{
+			name:     "graphite node keeps tcp check of port",
+			node:     StatsdNode{Host: "127.0.0.1", Port: 2003, Type: BackendTypeGraphite, HealthCheck: &HealthCheckConfig{Fall: 5}},
+			wantType: HealthCheckTCP,
+			want:     "127.0.0.1:2003",
+			timeout:  defaultHealthCheckTimeout,
+		},
+		{
+			name:     "graphite node with another port and timeout",
+			node:     StatsdNode{Host: "127.0.0.1", Port: 2003, Type: BackendTypeGraphite, HealthCheck: &HealthCheckConfig{Port: 2004, Timeout: 7}},
+			wantType: HealthCheckTCP,
+			want:     "127.0.0.1:2004",
+			timeout:  7 * time.Second,
+		},
+		{
+			name:           "influxdb http node keeps ping check",
+			node:           StatsdNode{Host: "127.0.0.1", Port: 8086, Type: BackendTypeInflux, Influx: influxHTTP, HealthCheck: &HealthCheckConfig{Rise: 4}},
+			wantType:       HealthCheckHTTP,
+			want:           "http://127.0.0.1:8086/ping",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "influxdb http node with another url",
+			node:           StatsdNode{Host: "127.0.0.1", Port: 8086, Type: BackendTypeInflux, Influx: influxHTTP, HealthCheck: &HealthCheckConfig{URL: "http://127.0.0.1:8086/health"}},
+			wantType:       HealthCheckHTTP,
+			want:           "http://127.0.0.1:8086/health",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:     "influxdb http node with tcp check",
+			node:     StatsdNode{Host: "127.0.0.1", Port: 8086, Type: BackendTypeInflux, Influx: influxHTTP, HealthCheck: &HealthCheckConfig{Type: HealthCheckTCP}},
+			wantType: HealthCheckTCP,
+			want:     "127.0.0.1:8086",
+			timeout:  defaultHealthCheckTimeout,
+		},
+		{
+			name:     "influxdb udp node with tcp check of its port",
+			node:     StatsdNode{Host: "127.0.0.1", Port: 8089, Type: BackendTypeInflux, HealthCheck: &HealthCheckConfig{Type: HealthCheckTCP}},
+			wantType: HealthCheckTCP,
+			want:     "127.0.0.1:8089",
+			timeout:  defaultHealthCheckTimeout,
+		},
+		{
+			name:     "graphite node without check",
+			node:     StatsdNode{Host: "127.0.0.1", Port: 2003, Type: BackendTypeGraphite, HealthCheck: &HealthCheckConfig{Type: HealthCheckNone}},
+			wantType: HealthCheckNone,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker, err := NewHealthChecker(test.node, discardLogger)
+			if err != nil {
+				t.Fatalf("NewHealthChecker failed: %v", err)
+			}
+			defer checker.Close()
+			switch checker := checker.(type) {
+			case *tcpHealthChecker:
+				if test.wantType != HealthCheckTCP || checker.address != test.want || checker.timeout != test.timeout {
+					t.Fatalf("got tcp check of %s with timeout %v, want %s check of %s with timeout %v", checker.address, checker.timeout, test.wantType, test.want, test.timeout)
+				}
+			case *httpHealthChecker:
+				if test.wantType != HealthCheckHTTP || checker.url != test.want || checker.expectedStatus != test.expectedStatus {
+					t.Fatalf("got http check of %s expecting %d, want %s check of %s expecting %d", checker.url, checker.expectedStatus, test.wantType, test.want, test.expectedStatus)
+				}
+			case noneHealthChecker:
+				if test.wantType != HealthCheckNone {
+					t.Fatalf("got no check, want %s check", test.wantType)
+				}
+			default:
+				t.Fatalf("got %T, want %s check", checker, test.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// HyperLogLog estimator of number of distinct strings
+package statsdrouter
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision of HyperLogLog, 2^10 registers give about 3% standard error
+const hyperLogLogPrecision = 10
+
+// HyperLogLog sketch, it is not safe for concurrent use
+type hyperLogLog struct {
+	registers [1 << hyperLogLogPrecision]uint8
+}
+
+// Adds a string to the sketch
+func (hll *hyperLogLog) add(value string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	// FNV doesn't mix high bits well, finalize it like splitmix64
+	x := hash.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	index := x >> (64 - hyperLogLogPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hyperLogLogPrecision|1<<(hyperLogLogPrecision-1)) + 1)
+	if rank > hll.registers[index] {
+		hll.registers[index] = rank
+	}
+}
+
+// Returns estimated number of distinct added strings
+func (hll *hyperLogLog) estimate() uint64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeros := 0
+	for _, register := range hll.registers {
+		sum += math.Ldexp(1, -int(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more precise for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
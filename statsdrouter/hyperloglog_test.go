@@ -0,0 +1,43 @@
+package statsdrouter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogEstimateErrorBounds(t *testing.T) {
+	// standard error with 2^10 registers is 1.04/sqrt(1024), about 3.25%;
+	// 4 standard errors keep the test stable for any fixed input
+	const maxError = 0.13
+	for _, count := range []int{10, 100, 1000, 5000, 20000, 100000} {
+		var hll hyperLogLog
+		for i := 0; i < count; i++ {
+			hll.add(fmt.Sprintf("app.service%d.requests", i))
+		}
+		estimate := hll.estimate()
+		relative := math.Abs(float64(estimate)-float64(count)) / float64(count)
+		if relative > maxError {
+			t.Errorf("estimate of %d names is %d, error %.1f%% is over %.0f%%", count, estimate, relative*100, maxError*100)
+		}
+	}
+}
+
+func TestHyperLogLogIgnoresDuplicates(t *testing.T) {
+	var hll hyperLogLog
+	for repeat := 0; repeat < 10; repeat++ {
+		for i := 0; i < 500; i++ {
+			hll.add(fmt.Sprintf("name%d", i))
+		}
+	}
+	if estimate := hll.estimate(); estimate < 450 || estimate > 550 {
+		t.Fatalf("estimate of 500 names added 10 times is %d", estimate)
+	}
+}
+
+func TestHyperLogLogEmpty(t *testing.T) {
+	var hll hyperLogLog
+	if estimate := hll.estimate(); estimate != 0 {
+		t.Fatalf("estimate of empty sketch is %d", estimate)
+	}
+}
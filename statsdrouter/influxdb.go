@@ -0,0 +1,397 @@
+// InfluxDB line protocol backend
+package statsdrouter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Transports of influxdb backends
+const (
+	InfluxProtocolUDP  = "udp"
+	InfluxProtocolHTTP = "http"
+)
+
+// Default settings of influxdb backends
+const (
+	DefaultInfluxBatchSize = 500
+	// seconds
+	DefaultInfluxFlushInterval = 1
+	DefaultInfluxTimeout       = 5
+	// bytes, for udp protocol
+	DefaultInfluxPacketSize = 1400
+	// field of metrics whose name doesn't give one
+	DefaultInfluxField = "value"
+)
+
+// Returned by writers when the backend refused a batch which must not be retried
+var errBatchRefused = errors.New("batch refused")
+
+// Mapping of dotted names of metrics with a prefix to measurement, field and tags
+type InfluxTemplate struct {
+	// Names with this prefix are mapped by the template, empty prefix matches all names
+	// when several prefixes match, the longest one is used
+	Prefix string `json:"prefix,omitempty"`
+	// Dot separated roles of name parts: measurement, field, _ (skipped) or a tag key;
+	// measurement* and field* as the last role take all remaining parts
+	Template string `json:"template"`
+}
+
+// Settings of an influxdb backend
+type InfluxConfig struct {
+	// One of InfluxProtocol* constants, udp by default
+	Protocol string `json:"protocol,omitempty"`
+	// Write endpoint for http protocol, http://host:port/write by default
+	URL string `json:"url,omitempty"`
+	// Database added to the write endpoint as db parameter
+	Database string `json:"database,omitempty"`
+	// Sent in "Authorization: Token <token>" header
+	Token string `json:"token,omitempty"`
+	// Name mappings, names without a template become measurements with the value field
+	Templates []InfluxTemplate `json:"templates,omitempty"`
+	// Tags added to every point
+	Tags map[string]string `json:"tags,omitempty"`
+	// Tag with StatsD type of the metric (counter, gauge, timing or set), none by default
+	TypeTag string `json:"type_tag,omitempty"`
+	// Max number of lines written at once, 500 by default
+	BatchSize int `json:"batch_size,omitempty"`
+	// Max time a line waits for its batch in seconds, 1 by default
+	FlushInterval int64 `json:"flush_interval,omitempty"`
+	// Timeout of a request in seconds, 5 by default
+	Timeout int64 `json:"timeout,omitempty"`
+	// Max size of a packet for udp protocol, 1400 by default
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+}
+
+// Checks settings and fills defaults
+// accepts the node the settings belong to
+// returns settings and an error
+func (config InfluxConfig) normalize(node StatsdNode) (InfluxConfig, error) {
+	if config.BatchSize < 0 || config.FlushInterval < 0 || config.Timeout < 0 || config.MaxPacketSize < 0 {
+		return config, errors.New("batch_size, flush_interval, timeout and max_packet_size can't be negative")
+	}
+	switch config.Protocol {
+	case "":
+		config.Protocol = InfluxProtocolUDP
+	case InfluxProtocolUDP:
+	case InfluxProtocolHTTP:
+		if config.URL == "" {
+			config.URL = fmt.Sprintf("http://%s/write", net.JoinHostPort(node.Host, fmt.Sprint(node.Port)))
+		}
+		endpoint, err := url.Parse(config.URL)
+		if err != nil {
+			return config, fmt.Errorf("invalid url: %w", err)
+		}
+		if config.Database != "" {
+			query := endpoint.Query()
+			query.Set("db", config.Database)
+			endpoint.RawQuery = query.Encode()
+			config.URL = endpoint.String()
+		}
+	default:
+		return config, fmt.Errorf("unknown influxdb protocol %q", config.Protocol)
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultInfluxBatchSize
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultInfluxFlushInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultInfluxTimeout
+	}
+	if config.MaxPacketSize == 0 {
+		config.MaxPacketSize = DefaultInfluxPacketSize
+	}
+	return config, nil
+}
+
+// Returns ping endpoint next to the write endpoint, it answers 204 when InfluxDB or Telegraf is up
+func (config InfluxConfig) pingURL() string {
+	endpoint, err := url.Parse(config.URL)
+	if err != nil {
+		return config.URL
+	}
+	return (&url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: "/ping"}).String()
+}
+
+// Compiled name mapping
+type influxTemplate struct {
+	prefix string
+	roles  []string
+}
+
+// Maps a dotted name to measurement, field and tags
+// parts beyond the template are appended to the measurement,
+// the whole name is the measurement if the template gives none
+func (template influxTemplate) apply(name string, tags map[string]string) (string, string) {
+	parts := strings.Split(name, ".")
+	var measurement, field []string
+parts:
+	for i, part := range parts {
+		role := "measurement*"
+		if i < len(template.roles) {
+			role = template.roles[i]
+		}
+		switch role {
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+			break parts
+		case "field*":
+			field = append(field, parts[i:]...)
+			break parts
+		case "measurement":
+			measurement = append(measurement, part)
+		case "field":
+			field = append(field, part)
+		case "_":
+		default:
+			tags[role] = part
+		}
+	}
+	if len(measurement) == 0 {
+		measurement = []string{name}
+	}
+	if len(field) == 0 {
+		field = []string{DefaultInfluxField}
+	}
+	return strings.Join(measurement, "."), strings.Join(field, ".")
+}
+
+// Compiles templates
+// returns them sorted by prefix length, the longest first, and an error
+func compileInfluxTemplates(configs []InfluxTemplate) ([]influxTemplate, error) {
+	templates := make([]influxTemplate, 0, len(configs))
+	prefixes := make(map[string]bool, len(configs))
+	for i, config := range configs {
+		if config.Template == "" {
+			return nil, fmt.Errorf("template %d: template is not set", i)
+		}
+		if prefixes[config.Prefix] {
+			return nil, fmt.Errorf("template %d: duplicate prefix %q", i, config.Prefix)
+		}
+		prefixes[config.Prefix] = true
+		roles := strings.Split(config.Template, ".")
+		for j, role := range roles {
+			if role == "" {
+				return nil, fmt.Errorf("template %d: empty part", i)
+			}
+			if (role == "measurement*" || role == "field*") && j != len(roles)-1 {
+				return nil, fmt.Errorf("template %d: %s has to be the last part", i, role)
+			}
+		}
+		templates = append(templates, influxTemplate{prefix: config.Prefix, roles: roles})
+	}
+	sort.SliceStable(templates, func(i, j int) bool {
+		return len(templates[i].prefix) > len(templates[j].prefix)
+	})
+	return templates, nil
+}
+
+// Escapes measurement names
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+
+// Escapes tag keys, tag values and field keys
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// Escapes string field values
+var influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+// StatsD types in the type tag
+var influxTypeNames = map[string]string{"c": "counter", "g": "gauge", "ms": "timing", "s": "set"}
+
+// Hands out strictly increasing timestamps in nanoseconds
+// InfluxDB keeps one point per series and timestamp, so lines of a packet taken at the same
+// time (timer samples, repeated counters) would overwrite each other with the same timestamp
+type influxClock struct {
+	last atomic.Int64
+}
+
+// Returns the time in nanoseconds or, if it was already given out, the next free nanosecond
+func (clock *influxClock) timestamp(now time.Time) int64 {
+	for {
+		last := clock.last.Load()
+		timestamp := max(now.UnixNano(), last+1)
+		if clock.last.CompareAndSwap(last, timestamp) {
+			return timestamp
+		}
+	}
+}
+
+// Formats metrics in InfluxDB line protocol, it is shared by udp and http writers
+// writers of a backend share the clock, so its points never have the same timestamp
+type influxFormatter struct {
+	config    InfluxConfig
+	templates []influxTemplate
+	clock     *influxClock
+}
+
+// Formats a metric as a "measurement,tags field=value timestamp" line
+// counters are divided by their sample rate, timers are written sample by sample
+// and sets as string fields; relative gauges can't be represented by a point
+// DogStatsD key:value tags override template tags which override tags of the config,
+// tags without value are skipped; every line gets its own timestamp from the clock
+// returns the buffer with the line appended and false if the metric is not accepted
+func (formatter *influxFormatter) format(buffer []byte, metric *StatsDMetric, now time.Time) ([]byte, bool) {
+	var value []byte
+	switch metric.metricType {
+	case "c":
+		value = strconv.AppendFloat(nil, metric.value/metric.SampleRate(), 'f', -1, 64)
+	case "g":
+		if strings.HasPrefix(metric.valueText, "+") || strings.HasPrefix(metric.valueText, "-") {
+			return buffer, false
+		}
+		value = strconv.AppendFloat(nil, metric.value, 'f', -1, 64)
+	case "ms":
+		value = strconv.AppendFloat(nil, metric.value, 'f', -1, 64)
+	case "s":
+		value = []byte(`"` + influxStringEscaper.Replace(metric.valueText) + `"`)
+	default:
+		return buffer, false
+	}
+	tags := make(map[string]string, len(formatter.config.Tags)+len(metric.tags)+1)
+	for key, tagValue := range formatter.config.Tags {
+		tags[key] = tagValue
+	}
+	measurement, field := metric.name, DefaultInfluxField
+	for _, template := range formatter.templates {
+		if strings.HasPrefix(metric.name, template.prefix) {
+			measurement, field = template.apply(metric.name, tags)
+			break
+		}
+	}
+	for _, tag := range metric.tags {
+		if key, tagValue, ok := strings.Cut(tag, ":"); ok && key != "" && tagValue != "" {
+			tags[key] = tagValue
+		}
+	}
+	if formatter.config.TypeTag != "" {
+		tags[formatter.config.TypeTag] = influxTypeNames[metric.metricType]
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buffer = append(buffer, influxMeasurementEscaper.Replace(measurement)...)
+	for _, key := range keys {
+		buffer = append(buffer, ',')
+		buffer = append(buffer, influxKeyEscaper.Replace(key)...)
+		buffer = append(buffer, '=')
+		buffer = append(buffer, influxKeyEscaper.Replace(tags[key])...)
+	}
+	buffer = append(buffer, ' ')
+	buffer = append(buffer, influxKeyEscaper.Replace(field)...)
+	buffer = append(buffer, '=')
+	buffer = append(buffer, value...)
+	buffer = append(buffer, ' ')
+	buffer = strconv.AppendInt(buffer, formatter.clock.timestamp(now), 10)
+	buffer = append(buffer, '\n')
+	return buffer, true
+}
+
+// Writes batches of lines in InfluxDB line protocol in UDP packets
+type influxUDPWriter struct {
+	influxFormatter
+	address string
+	conn    net.Conn
+}
+
+// Writes a batch in packets of up to max_packet_size bytes, dialing first if there is no connection
+// returns an error
+func (writer *influxUDPWriter) write(batch []byte) error {
+	if writer.conn == nil {
+		conn, err := net.Dial("udp", writer.address)
+		if err != nil {
+			return fmt.Errorf("failed to dial: %w", err)
+		}
+		writer.conn = conn
+	}
+	lines := strings.Split(strings.TrimSuffix(string(batch), "\n"), "\n")
+	for _, packet := range packLines(lines, writer.config.MaxPacketSize) {
+		if _, err := writer.conn.Write(packet); err != nil {
+			writer.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes the connection
+func (writer *influxUDPWriter) close() {
+	if writer.conn != nil {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+}
+
+// Writes batches of lines in InfluxDB line protocol to the HTTP write endpoint
+type influxHTTPWriter struct {
+	influxFormatter
+	client *http.Client
+}
+
+// Posts a batch to the write endpoint
+// server errors and 429 are returned to be retried, other statuses refuse the batch
+// returns an error
+func (writer *influxHTTPWriter) write(batch []byte) error {
+	request, err := http.NewRequest(http.MethodPost, writer.config.URL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if writer.config.Token != "" {
+		request.Header.Set("Authorization", "Token "+writer.config.Token)
+	}
+	response, err := writer.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("unexpected status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+	return fmt.Errorf("%w with status %d: %s", errBatchRefused, response.StatusCode, bytes.TrimSpace(body))
+}
+
+// Closes idle connections
+func (writer *influxHTTPWriter) close() {
+	writer.client.CloseIdleConnections()
+}
+
+// Creates a function which creates writers of the influxdb backend
+// accepts the node and normalized settings as parameters
+// returns the function and an error
+func newInfluxWriterFactory(node StatsdNode, config InfluxConfig, logger *slog.Logger) (func() batchWriter, error) {
+	templates, err := compileInfluxTemplates(config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	formatter := influxFormatter{config: config, templates: templates, clock: &influxClock{}}
+	if config.Protocol == InfluxProtocolHTTP {
+		logger.Debug("Using InfluxDB HTTP write endpoint", "url", config.URL)
+		return func() batchWriter {
+			return &influxHTTPWriter{influxFormatter: formatter, client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}}
+		}, nil
+	}
+	address := net.JoinHostPort(node.Host, fmt.Sprint(node.Port))
+	return func() batchWriter {
+		return &influxUDPWriter{influxFormatter: formatter, address: address}
+	}, nil
+}
@@ -0,0 +1,255 @@
+package statsdrouter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Settings which map names to measurements, fields and tags, used by the tests
+var testInfluxConfig = InfluxConfig{
+	Tags:    map[string]string{"dc": "eu", "env": "dev"},
+	TypeTag: "metric_type",
+	Templates: []InfluxTemplate{
+		{Prefix: "apps.", Template: "_.service.measurement.field*"},
+	},
+}
+
+// Packet of the tests and its lines without timestamps
+const testInfluxPacket = "apps.web.requests.latency.p99:12|ms|#env:prod\n" +
+	"apps.web.requests.latency.p99:15|ms|#env:prod\n" +
+	"hits:1|c|@0.5|#host:a b,canary\n" +
+	"hits:1|c|@0.5|#host:a b,canary\n" +
+	"apps.web.users:al\"ice|s\n" +
+	"temp:21.5|g\n" +
+	"temp:+1|g"
+
+var testInfluxLines = []string{
+	"requests,dc=eu,env=prod,metric_type=timing,service=web latency.p99=12",
+	"requests,dc=eu,env=prod,metric_type=timing,service=web latency.p99=15",
+	`hits,dc=eu,env=dev,host=a\ b,metric_type=counter value=2`,
+	`hits,dc=eu,env=dev,host=a\ b,metric_type=counter value=2`,
+	`users,dc=eu,env=dev,metric_type=set,service=web value="al\"ice"`,
+	"temp,dc=eu,env=dev,metric_type=gauge value=21.5",
+}
+
+// Splits line protocol into lines without timestamps and checks that timestamps
+// are strictly increasing, so no point overwrites another one
+func splitInfluxLines(t *testing.T, data string) []string {
+	t.Helper()
+	var lines []string
+	var last int64
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		separator := strings.LastIndexByte(line, ' ')
+		timestamp, err := strconv.ParseInt(line[separator+1:], 10, 64)
+		if err != nil {
+			t.Fatalf("line %q has no timestamp: %v", line, err)
+		}
+		if timestamp <= last {
+			t.Fatalf("timestamp of %q is not after %d", line, last)
+		}
+		last = timestamp
+		lines = append(lines, line[:separator])
+	}
+	return lines
+}
+
+func assertInfluxLines(t *testing.T, got []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(testInfluxLines, "\n") {
+		t.Fatalf("got lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(testInfluxLines, "\n"))
+	}
+}
+
+// Creates an influxdb backend without health check which writes every packet at once
+func newTestInfluxBackend(t *testing.T, node StatsdNode) *StatsDBackend {
+	t.Helper()
+	node.Type = BackendTypeInflux
+	node.HealthCheck = &HealthCheckConfig{Type: HealthCheckNone}
+	backend, err := NewStatsDBackend(node, BackendOptions{
+		CheckInterval:          3600,
+		UnhealthyCheckInterval: 3600,
+		QueueSize:              16,
+		Senders:                1,
+		OverflowPolicy:         OverflowPolicyDropNewest,
+	}, discardLogger)
+	if err != nil {
+		t.Fatalf("NewStatsDBackend failed: %v", err)
+	}
+	t.Cleanup(func() { backend.Close(context.Background()) })
+	return backend
+}
+
+func TestInfluxFormatGivesEveryLineItsTimestamp(t *testing.T) {
+	config, err := testInfluxConfig.normalize(StatsdNode{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWriter, err := newInfluxWriterFactory(StatsdNode{Host: "127.0.0.1", Port: 8089}, config, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writers of a backend share the clock
+	writers := []batchWriter{newWriter(), newWriter()}
+	now := time.Unix(1700000000, 0)
+	var batch []byte
+	for i, metric := range parsePacket([]byte("lat:1|ms\nlat:2|ms\nhits:1|c\nhits:1|c")) {
+		batch, _ = writers[i%2].format(batch, metric, now)
+	}
+	want := "lat,dc=eu,env=dev,metric_type=timing value=1 1700000000000000000\n" +
+		"lat,dc=eu,env=dev,metric_type=timing value=2 1700000000000000001\n" +
+		"hits,dc=eu,env=dev,metric_type=counter value=1 1700000000000000002\n" +
+		"hits,dc=eu,env=dev,metric_type=counter value=1 1700000000000000003\n"
+	if string(batch) != want {
+		t.Fatalf("got\n%swant\n%s", batch, want)
+	}
+}
+
+func TestInfluxHTTPWrite(t *testing.T) {
+	var lock sync.Mutex
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		lock.Lock()
+		requests = append(requests, request)
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		response.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := testInfluxConfig
+	config.Protocol = InfluxProtocolHTTP
+	config.URL = server.URL + "/write"
+	config.Database = "stats"
+	config.Token = "secret"
+	config.BatchSize = 6
+	backend := newTestInfluxBackend(t, StatsdNode{Host: "127.0.0.1", Port: 8086, Influx: &config})
+	backend.Enqueue([]byte(testInfluxPacket))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.Stats.PacketsSent.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not written, %d send errors", backend.Stats.SendErrors.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if request.Method != http.MethodPost || request.URL.Path != "/write" || request.URL.Query().Get("db") != "stats" {
+		t.Errorf("got %s %s, want POST /write?db=stats", request.Method, request.URL)
+	}
+	if got := request.Header.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization header %q", got)
+	}
+	assertInfluxLines(t, splitInfluxLines(t, bodies[0]))
+	if got := backend.Stats.Rejected.Load(); got != 1 {
+		t.Errorf("rejected %d metrics, want the relative gauge", got)
+	}
+}
+
+func TestInfluxHTTPRefusedBatchIsDropped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "unable to parse", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	config := InfluxConfig{Protocol: InfluxProtocolHTTP, URL: server.URL + "/write", BatchSize: 1}
+	backend := newTestInfluxBackend(t, StatsdNode{Host: "127.0.0.1", Port: 8086, Influx: &config})
+	backend.Enqueue([]byte("hits:1|c"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.Stats.Dropped.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("refused batch was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a refused batch is not retried
+	if got := backend.Stats.SendErrors.Load(); got != 1 {
+		t.Fatalf("batch was written %d times, want 1", got)
+	}
+}
+
+func TestInfluxHTTPServerErrorsAreRetriedThenDropped(t *testing.T) {
+	var lock sync.Mutex
+	var times []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		times = append(times, time.Now())
+		lock.Unlock()
+		http.Error(response, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := InfluxConfig{Protocol: InfluxProtocolHTTP, URL: server.URL + "/write", BatchSize: 1}
+	backend := newTestInfluxBackend(t, StatsdNode{Host: "127.0.0.1", Port: 8086, Influx: &config})
+	backend.Enqueue([]byte("hits:1|c"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.Stats.Dropped.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch was not dropped after retries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(times) != maxBatchWriteAttempts {
+		t.Fatalf("got %d requests, want %d", len(times), maxBatchWriteAttempts)
+	}
+	// the delay doubles after every attempt
+	delay := minBatchRetryDelay
+	for i := 1; i < len(times); i++ {
+		if waited := times[i].Sub(times[i-1]); waited < delay {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, waited, delay)
+		}
+		delay *= 2
+	}
+}
+
+func TestInfluxUDPWrite(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := testInfluxConfig
+	config.BatchSize = 6
+	// every packet holds a few lines only
+	config.MaxPacketSize = 150
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	backend := newTestInfluxBackend(t, StatsdNode{Host: "127.0.0.1", Port: uint16(port), Influx: &config})
+	backend.Enqueue([]byte(testInfluxPacket))
+
+	var data strings.Builder
+	buffer := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for packets := 0; strings.Count(data.String(), "\n") < len(testInfluxLines)-1; packets++ {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("got %d packets with\n%s\nthen %v", packets, data.String(), err)
+		}
+		if n > config.MaxPacketSize {
+			t.Fatalf("packet of %d bytes is over max_packet_size", n)
+		}
+		if data.Len() > 0 {
+			data.WriteByte('\n')
+		}
+		data.Write(buffer[:n])
+	}
+	assertInfluxLines(t, splitInfluxLines(t, data.String()))
+}
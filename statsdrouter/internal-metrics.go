@@ -0,0 +1,153 @@
+// Sends router's own metrics to StatsD
+package statsdrouter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Max size of a packet with internal metrics
+const internalMetricsPacketSize = 1400
+
+// Internal metrics sender settings
+type InternalMetricsConfig struct {
+	// Prefix of all internal metric names
+	Prefix string
+	// Interval between flushes in seconds, 0 disables the sender
+	Interval int64
+	// Backend key (host:port:mgmt_port) to send metrics to, empty means master backend
+	Backend string
+}
+
+// Internal metrics sender struct
+type internalMetricsSender struct {
+	config InternalMetricsConfig
+	router *Router
+	// previous values of counters to send deltas
+	lastValues map[string]uint64
+	lines      []string
+	logger     *slog.Logger
+}
+
+// Periodically sends router's counters and gauges
+// as StatsD metrics to the master or configured backend until ctx is done
+// returns an error
+func (router *Router) runInternalMetrics(ctx context.Context) error {
+	config := router.options.InternalMetrics
+	logger := router.logging.Logger(ComponentMetrics)
+	if config.Interval <= 0 {
+		logger.Info("Internal metrics sender is disabled")
+		return nil
+	}
+	sender := &internalMetricsSender{config: config, router: router, lastValues: make(map[string]uint64), logger: logger}
+	logger.Info("Starting internal metrics sender", "prefix", config.Prefix, "interval", config.Interval)
+	tick := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			sender.flush()
+		case <-ctx.Done():
+			logger.Debug("Terminating internal metrics sender")
+			return nil
+		}
+	}
+}
+
+// Adds a counter, only the difference with the previous flush is sent
+func (sender *internalMetricsSender) counter(name string, value uint64) {
+	delta := value - sender.lastValues[name]
+	sender.lastValues[name] = value
+	sender.lines = append(sender.lines, fmt.Sprintf("%s.%s:%d|c", sender.config.Prefix, name, delta))
+}
+
+// Adds a gauge
+func (sender *internalMetricsSender) gauge(name string, value interface{}) {
+	sender.lines = append(sender.lines, fmt.Sprintf("%s.%s:%v|g", sender.config.Prefix, name, value))
+}
+
+// Collects all internal metrics and sends them to the target backend
+// lines for the master go through its aggregation if it has one, backends which require
+// aggregation (graphite) can receive them only as the master
+func (sender *internalMetricsSender) flush() {
+	stats, routingMap, masterBackend := sender.router.stats, sender.router.routingMap, sender.router.masterBackend
+	sender.lines = sender.lines[:0]
+	packets := stats.PacketsReceived.Load()
+	sender.gauge("packets_per_second", (packets-sender.lastValues["packets_received"])/uint64(sender.config.Interval))
+	sender.counter("packets_received", packets)
+	sender.counter("lines_received", stats.LinesReceived.Load())
+	sender.counter("processor_drops", stats.ProcessorDrops.Load())
+	for reason, counter := range stats.ParseErrors {
+		sender.counter("parse_errors."+reason, counter.Load())
+	}
+	backends := append([]*StatsDBackend{masterBackend}, routingMap.Backends()...)
+	for _, backend := range backends {
+		name := "backends." + metricNameSanitizer.Replace(backend.Key())
+		sender.gauge(name+".queue_depth", len(backend.SendChannel))
+		sender.gauge(name+".alive", boolGauge(backend.Status().Alive))
+		sender.gauge(name+".active", boolGauge(backend.Mode() == BackendModeActive))
+		sender.counter(name+".sent", backend.Stats.PacketsSent.Load())
+		sender.counter(name+".dropped", backend.Stats.Dropped.Load())
+		sender.counter(name+".queue_dropped", backend.Stats.QueueDrops.Load())
+		sender.counter(name+".send_errors", backend.Stats.SendErrors.Load())
+		sender.counter(name+".address_changes", backend.Stats.AddressChanges.Load())
+	}
+
+	target := masterBackend
+	if sender.config.Backend != "" && sender.config.Backend != masterBackend.Key() {
+		target = routingMap.Backend(sender.config.Backend)
+		if target == nil {
+			sender.logger.Warn("Failed to send internal metrics: unknown backend", "backend", sender.config.Backend)
+			return
+		}
+		if target.Type == BackendTypeGraphite {
+			sender.logger.Warn("Failed to send internal metrics: graphite backend requires aggregation, only the master can receive them", "backend", target.Key())
+			return
+		}
+	}
+	if target == masterBackend {
+		metrics := make([]*StatsDMetric, 0, len(sender.lines))
+		for _, line := range sender.lines {
+			if metric, err := parseMetric(line); err == nil {
+				metrics = append(metrics, metric)
+			}
+		}
+		if sender.router.aggregate("", metrics...) {
+			return
+		}
+	}
+	if send, reason := backendDecision(target); !send {
+		sender.logger.Debug("Skipping internal metrics", "backend", target.Key(), "reason", reason)
+		return
+	}
+	for _, packet := range packLines(sender.lines, internalMetricsPacketSize) {
+		target.Enqueue(packet)
+	}
+}
+
+// Replaces characters which have special meaning in Graphite metric names
+var metricNameSanitizer = strings.NewReplacer(".", "_", ":", "_")
+
+// Joins lines into newline separated packets not bigger than maxSize
+// (a single line longer than maxSize gets its own packet)
+func packLines(lines []string, maxSize int) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxSize {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,53 @@
+package statsdrouter
+
+import (
+	"testing"
+	"time"
+)
+
+// Collects and sends internal metrics of the router once
+func flushInternalMetrics(router *Router, backend string) {
+	sender := &internalMetricsSender{
+		config:     InternalMetricsConfig{Prefix: "statsd-router", Interval: 10, Backend: backend},
+		router:     router,
+		lastValues: make(map[string]uint64),
+		logger:     discardLogger,
+	}
+	sender.flush()
+}
+
+func TestInternalMetricsGoThroughMasterAggregation(t *testing.T) {
+	router := newTestRouter(t, &RouterConfig{
+		Aggregation: &AggregationsConfig{Master: &AggregationConfig{FlushInterval: 3600}},
+	})
+	flushInternalMetrics(router, "")
+	if got := router.MasterAggregator().Stats.Received.Load(); got == 0 {
+		t.Fatal("internal metrics were not added to the master aggregator")
+	}
+	if got := len(router.MasterBackend().SendChannel); got != 0 {
+		t.Fatalf("%d packets were queued to the master past its aggregation", got)
+	}
+}
+
+func TestInternalMetricsAreQueuedWithoutAggregation(t *testing.T) {
+	router := newTestRouter(t, &RouterConfig{})
+	flushInternalMetrics(router, "")
+	if got := len(router.MasterBackend().SendChannel); got == 0 {
+		t.Fatal("internal metrics were not queued to the master")
+	}
+}
+
+func TestInternalMetricsAreNotSentToGraphiteBackend(t *testing.T) {
+	// every line is written at once and fails, as nothing listens on the port
+	graphite := StatsdNode{Host: "127.0.0.1", Port: closedPort(t), Type: BackendTypeGraphite, Graphite: &GraphiteConfig{BatchSize: 1}}
+	router := newTestRouter(t, &RouterConfig{
+		Rules:       map[string][]StatsdNode{`^app\.`: {graphite}},
+		Aggregation: &AggregationsConfig{Rules: map[string]AggregationConfig{`^app\.`: {FlushInterval: 3600}}},
+	})
+	backend := router.Backend(graphite.Key())
+	flushInternalMetrics(router, graphite.Key())
+	time.Sleep(100 * time.Millisecond)
+	if len(backend.SendChannel) != 0 || backend.Stats.SendErrors.Load() != 0 || backend.Stats.Rejected.Load() != 0 {
+		t.Fatal("internal metrics were queued to the graphite backend")
+	}
+}
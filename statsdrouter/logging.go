@@ -0,0 +1,137 @@
+// Leveled structured logging with per-component levels
+package statsdrouter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Logging components, each of them has its own level
+const (
+	ComponentRouter   = "router"
+	ComponentListener = "listener"
+	ComponentRouting  = "routing"
+	ComponentBackend  = "backend"
+	ComponentApi      = "api"
+	ComponentMetrics  = "metrics"
+)
+
+// Log formats
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// Logging struct
+// creates loggers for components and keeps their levels
+type Logging struct {
+	writer io.Writer
+	format string
+	// the set of components is fixed, so the map is only read after creation
+	levels map[string]*slog.LevelVar
+}
+
+// Creates a new Logging struct
+// accepts a writer, a format (logfmt or json) and a default level of all components
+// returns the *Logging struct and an error
+func NewLogging(writer io.Writer, format string, level slog.Level) (*Logging, error) {
+	switch format {
+	case LogFormatLogfmt, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	logging := &Logging{writer: writer, format: format, levels: make(map[string]*slog.LevelVar)}
+	for _, component := range []string{ComponentRouter, ComponentListener, ComponentRouting, ComponentBackend, ComponentApi, ComponentMetrics} {
+		logging.levels[component] = new(slog.LevelVar)
+		logging.levels[component].Set(level)
+	}
+	return logging, nil
+}
+
+// Returns a logger of the component
+func (logging *Logging) Logger(component string) *slog.Logger {
+	level, ok := logging.levels[component]
+	if !ok {
+		level = logging.levels[ComponentRouter]
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if logging.format == LogFormatJSON {
+		handler = slog.NewJSONHandler(logging.writer, options)
+	} else {
+		handler = slog.NewTextHandler(logging.writer, options)
+	}
+	return slog.New(handler).With("component", component)
+}
+
+// Changes level of the component at runtime
+// returns an error if there is no such component
+func (logging *Logging) SetLevel(component string, level slog.Level) error {
+	levelVar, ok := logging.levels[component]
+	if !ok {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	levelVar.Set(level)
+	return nil
+}
+
+// Returns current levels of all components
+func (logging *Logging) Levels() map[string]string {
+	levels := make(map[string]string, len(logging.levels))
+	for component, level := range logging.levels {
+		levels[component] = level.Level().String()
+	}
+	return levels
+}
+
+// Returns sorted names of all components
+func (logging *Logging) Components() []string {
+	components := make([]string, 0, len(logging.levels))
+	for component := range logging.levels {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// Logger which writes at most one message per interval
+// and reports how many messages were suppressed in between
+type RateLimitedLogger struct {
+	logger     *slog.Logger
+	interval   time.Duration
+	next       atomic.Int64
+	suppressed atomic.Uint64
+}
+
+// Creates a new RateLimitedLogger
+// accepts a logger and a minimal interval between messages
+func NewRateLimitedLogger(logger *slog.Logger, interval time.Duration) *RateLimitedLogger {
+	return &RateLimitedLogger{logger: logger, interval: interval}
+}
+
+// Writes the message if the interval since the previous one has passed
+func (limited *RateLimitedLogger) Log(level slog.Level, msg string, args ...any) {
+	if !limited.logger.Enabled(context.Background(), level) {
+		return
+	}
+	now := time.Now().UnixNano()
+	next := limited.next.Load()
+	if now < next || !limited.next.CompareAndSwap(next, now+int64(limited.interval)) {
+		limited.suppressed.Add(1)
+		return
+	}
+	if suppressed := limited.suppressed.Swap(0); suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	limited.logger.Log(context.Background(), level, msg, args...)
+}
+
+// Writes the message with warning level
+func (limited *RateLimitedLogger) Warn(msg string, args ...any) {
+	limited.Log(slog.LevelWarn, msg, args...)
+}
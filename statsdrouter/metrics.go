@@ -0,0 +1,217 @@
+// Internal router metrics and their Prometheus exposition
+package statsdrouter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Reasons of parse errors
+var (
+	errNoValueSeparator = errors.New("no value separator")
+	errNoTypeSeparator  = errors.New("no type separator")
+	errUnknownType      = errors.New("unknown metric type")
+)
+
+// Router counters
+// all of them are updated with atomic operations, so it is safe to read them at any time
+type RouterStats struct {
+	PacketsReceived        atomic.Uint64
+	LinesReceived          atomic.Uint64
+	ParseErrors            map[string]*atomic.Uint64
+	ConfigReloadsSucceeded atomic.Uint64
+	ConfigReloadsFailed    atomic.Uint64
+	// Metrics dropped by processor chains
+	ProcessorDrops atomic.Uint64
+}
+
+// Creates a new RouterStats struct with zero counters
+// returns the *RouterStats struct
+func NewRouterStats() *RouterStats {
+	return &RouterStats{
+		ParseErrors: map[string]*atomic.Uint64{
+			"no_value_separator": new(atomic.Uint64),
+			"no_type_separator":  new(atomic.Uint64),
+			"unknown_type":       new(atomic.Uint64),
+			"other":              new(atomic.Uint64),
+		},
+	}
+}
+
+// Increments parse errors counter of the error's reason
+func (stats *RouterStats) countParseError(err error) {
+	reason := "other"
+	switch {
+	case errors.Is(err, errNoValueSeparator):
+		reason = "no_value_separator"
+	case errors.Is(err, errNoTypeSeparator):
+		reason = "no_type_separator"
+	case errors.Is(err, errUnknownType):
+		reason = "unknown_type"
+	}
+	stats.ParseErrors[reason].Add(1)
+}
+
+// Escapes label value according to Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes HELP and TYPE lines of a metric family
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Writes one sample of a metric, labels are pairs of label name and value
+func writeMetricSample(w io.Writer, name string, value interface{}, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
+
+// Converts bool to Prometheus gauge value
+func boolGauge(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Returns a spool counter of the backend or 0 if it has no spool
+func spoolStat(backend *StatsDBackend, value func(spool *Spool) uint64) uint64 {
+	if spool := backend.Spool(); spool != nil {
+		return value(spool)
+	}
+	return 0
+}
+
+// Endpoint to expose internal metrics in Prometheus text format
+func (api *HttpApi) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "statsd_router_packets_received_total", "counter", "Number of UDP packets received.")
+	writeMetricSample(w, "statsd_router_packets_received_total", api.stats.PacketsReceived.Load())
+	writeMetricHeader(w, "statsd_router_lines_received_total", "counter", "Number of metric lines received.")
+	writeMetricSample(w, "statsd_router_lines_received_total", api.stats.LinesReceived.Load())
+	writeMetricHeader(w, "statsd_router_parse_errors_total", "counter", "Number of malformatted metric lines by reason.")
+	for _, reason := range []string{"no_value_separator", "no_type_separator", "unknown_type", "other"} {
+		writeMetricSample(w, "statsd_router_parse_errors_total", api.stats.ParseErrors[reason].Load(), "reason", reason)
+	}
+	writeMetricHeader(w, "statsd_router_config_reloads_total", "counter", "Number of config updates by result.")
+	writeMetricSample(w, "statsd_router_config_reloads_total", api.stats.ConfigReloadsSucceeded.Load(), "result", "success")
+	writeMetricSample(w, "statsd_router_config_reloads_total", api.stats.ConfigReloadsFailed.Load(), "result", "failure")
+	writeMetricHeader(w, "statsd_router_processor_drops_total", "counter", "Number of metrics dropped by processors.")
+	writeMetricSample(w, "statsd_router_processor_drops_total", api.stats.ProcessorDrops.Load())
+	writeMetricHeader(w, "statsd_router_rate_limited_lines_total", "counter", "Number of lines checked by rate limiters by result.")
+	for _, limiter := range api.router.RateLimiters() {
+		key := limiter.Config.Key()
+		writeMetricSample(w, "statsd_router_rate_limited_lines_total", limiter.Stats.Allowed.Load(), "limiter", key, "result", "allowed")
+		writeMetricSample(w, "statsd_router_rate_limited_lines_total", limiter.Stats.Sampled.Load(), "limiter", key, "result", "sampled")
+		writeMetricSample(w, "statsd_router_rate_limited_lines_total", limiter.Stats.Dropped.Load(), "limiter", key, "result", "dropped")
+	}
+	writeMetricHeader(w, "statsd_router_aggregated_lines_total", "counter", "Number of lines added to aggregators and sent at flush time.")
+	aggregators := map[string]*Aggregator{}
+	names := []string{}
+	if master := api.router.MasterAggregator(); master != nil {
+		aggregators["master"] = master
+		names = append(names, "master")
+	}
+	for rule, aggregator := range api.router.RuleAggregators() {
+		aggregators["rule:"+rule] = aggregator
+		names = append(names, "rule:"+rule)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricSample(w, "statsd_router_aggregated_lines_total", aggregators[name].Stats.Received.Load(), "aggregation", name, "stage", "received")
+		writeMetricSample(w, "statsd_router_aggregated_lines_total", aggregators[name].Stats.Flushed.Load(), "aggregation", name, "stage", "flushed")
+	}
+	writeMetricHeader(w, "statsd_router_cardinality_rejected_total", "counter", "Number of metrics with new names over cardinality limits.")
+	for _, limiter := range api.router.CardinalityLimiters() {
+		writeMetricSample(w, "statsd_router_cardinality_rejected_total", limiter.Stats.Rejected.Load(), "prefix", limiter.Config.Prefix)
+	}
+
+	writeMetricHeader(w, "statsd_router_rule_matches_total", "counter", "Number of metrics matched by rule.")
+	for _, rule := range api.routingMap.Rules() {
+		writeMetricSample(w, "statsd_router_rule_matches_total", rule.Matches.Load(), "rule", rule.Regexp.String())
+	}
+
+	backends := append([]*StatsDBackend{api.masterBackend}, api.routingMap.Backends()...)
+	families := []struct {
+		name       string
+		metricType string
+		help       string
+		value      func(backend *StatsDBackend) interface{}
+	}{
+		{"statsd_router_backend_up", "gauge", "Whether the backend passed the last health check.",
+			func(backend *StatsDBackend) interface{} { return boolGauge(backend.Status().Alive) }},
+		{"statsd_router_backend_active", "gauge", "Whether the backend is in active mode.",
+			func(backend *StatsDBackend) interface{} { return boolGauge(backend.Mode() == BackendModeActive) }},
+		{"statsd_router_backend_sent_packets_total", "counter", "Number of packets sent to the backend.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.PacketsSent.Load() }},
+		{"statsd_router_backend_sent_bytes_total", "counter", "Number of bytes sent to the backend.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.BytesSent.Load() }},
+		{"statsd_router_backend_send_errors_total", "counter", "Number of failed writes to the backend.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.SendErrors.Load() }},
+		{"statsd_router_backend_dropped_total", "counter", "Number of metrics not sent to the backend because of its status or mode.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.Dropped.Load() }},
+		{"statsd_router_backend_queue_dropped_total", "counter", "Number of metrics dropped because the backend queue was full.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.QueueDrops.Load() }},
+		{"statsd_router_backend_spool_bytes", "gauge", "Size of spooled metrics on disk.",
+			func(backend *StatsDBackend) interface{} {
+				return spoolStat(backend, func(spool *Spool) uint64 { return uint64(spool.Size.Load()) })
+			}},
+		{"statsd_router_backend_spooled_total", "counter", "Number of metrics written to the spool.",
+			func(backend *StatsDBackend) interface{} {
+				return spoolStat(backend, func(spool *Spool) uint64 { return spool.Spooled.Load() })
+			}},
+		{"statsd_router_backend_spool_replayed_total", "counter", "Number of metrics replayed from the spool.",
+			func(backend *StatsDBackend) interface{} {
+				return spoolStat(backend, func(spool *Spool) uint64 { return spool.Replayed.Load() })
+			}},
+		{"statsd_router_backend_spool_dropped_total", "counter", "Number of spooled metrics dropped because of spool limits.",
+			func(backend *StatsDBackend) interface{} {
+				return spoolStat(backend, func(spool *Spool) uint64 { return spool.Dropped.Load() })
+			}},
+		{"statsd_router_backend_queue_depth", "gauge", "Number of metrics waiting in the backend queue.",
+			func(backend *StatsDBackend) interface{} { return len(backend.SendChannel) }},
+		{"statsd_router_backend_health_checks_up_total", "counter", "Number of health checks which reported the backend up.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.HealthChecksUp.Load() }},
+		{"statsd_router_backend_health_checks_down_total", "counter", "Number of health checks which reported the backend down.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.HealthChecksDown.Load() }},
+		{"statsd_router_backend_address_changes_total", "counter", "Number of times the backend hostname resolved to a new address.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.AddressChanges.Load() }},
+		{"statsd_router_backend_passive_failures_total", "counter", "Number of send errors reported to the health checker.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.PassiveFailures.Load() }},
+		{"statsd_router_backend_rejected_total", "counter", "Number of metrics the backend type doesn't accept.",
+			func(backend *StatsDBackend) interface{} { return backend.Stats.Rejected.Load() }},
+		{"statsd_router_backend_suspect", "gauge", "Whether the backend is suspect because of send errors (1) or not (0).",
+			func(backend *StatsDBackend) interface{} { return boolGauge(backend.Status().Suspect) }},
+		{"statsd_router_backend_health_check_seconds_total", "counter", "Total time spent in health checks.",
+			func(backend *StatsDBackend) interface{} {
+				return float64(backend.Stats.HealthCheckNanoseconds.Load()) / 1e9
+			}},
+		{"statsd_router_backend_last_health_check_duration_seconds", "gauge", "Duration of the last health check.",
+			func(backend *StatsDBackend) interface{} {
+				return float64(backend.Stats.LastHealthCheckNanoseconds.Load()) / 1e9
+			}},
+	}
+	for _, family := range families {
+		writeMetricHeader(w, family.name, family.metricType, family.help)
+		for i, backend := range backends {
+			writeMetricSample(w, family.name, family.value(backend), "backend", backend.Key(), "master", fmt.Sprint(i == 0))
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Metric processors which change, drop or fan out metrics before they are routed
+package statsdrouter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Changes, drops or fans out metrics
+// Process calls emit for every metric which has to be routed further:
+// once for the (possibly changed) metric, never to drop it or several times to fan it out.
+// Fanned out metrics must be different objects, use Clone to copy the metric.
+// Processors are called concurrently by metric handlers and must be safe for it
+type Processor interface {
+	Process(metric *StatsDMetric, emit func(*StatsDMetric))
+}
+
+// Adapter to use an ordinary function as a Processor
+type ProcessorFunc func(metric *StatsDMetric, emit func(*StatsDMetric))
+
+// Calls the function
+func (f ProcessorFunc) Process(metric *StatsDMetric, emit func(*StatsDMetric)) {
+	f(metric, emit)
+}
+
+// Creates a processor from its options in the config
+type ProcessorFactory func(options json.RawMessage) (Processor, error)
+
+// Processor settings in the config
+type ProcessorConfig struct {
+	// Name the processor was registered with
+	Type string `json:"type"`
+	// Options of the processor, their format depends on the type
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// Registered processor factories
+var (
+	processorFactoriesLock sync.RWMutex
+	processorFactories     = make(map[string]ProcessorFactory)
+)
+
+// Makes a processor type available in the config
+// it is meant to be called from init functions of packages compiled into custom builds
+// panics if the name is already registered
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processorFactoriesLock.Lock()
+	defer processorFactoriesLock.Unlock()
+	if _, ok := processorFactories[name]; ok {
+		panic(fmt.Sprintf("processor %q is already registered", name))
+	}
+	processorFactories[name] = factory
+}
+
+// Returns names of registered processor types in sorted order
+func ProcessorTypes() []string {
+	processorFactoriesLock.RLock()
+	defer processorFactoriesLock.RUnlock()
+	names := make([]string, 0, len(processorFactories))
+	for name := range processorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates processors of a chain
+// accepts processor settings in chain order
+// returns the processors and an error
+func NewProcessors(configs []ProcessorConfig) ([]Processor, error) {
+	processors := make([]Processor, 0, len(configs))
+	for i, config := range configs {
+		processorFactoriesLock.RLock()
+		factory := processorFactories[config.Type]
+		processorFactoriesLock.RUnlock()
+		if factory == nil {
+			return nil, fmt.Errorf("processor %d: unknown type %q", i, config.Type)
+		}
+		processor, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d (%s): %w", i, config.Type, err)
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+// Passes the metric through the chain of processors
+// emit is called for every metric which came out of the last processor
+// returns number of emitted metrics
+func runProcessors(processors []Processor, metric *StatsDMetric, emit func(*StatsDMetric)) int {
+	if len(processors) == 0 {
+		emit(metric)
+		return 1
+	}
+	emitted := 0
+	processors[0].Process(metric, func(metric *StatsDMetric) {
+		emitted += runProcessors(processors[1:], metric, emit)
+	})
+	return emitted
+}
+
+// Unmarshals processor options, missing options are treated as an empty object
+func unmarshalProcessorOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(options, v); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	RegisterProcessor("add_tags", newAddTagsProcessor)
+	RegisterProcessor("sanitize_name", newSanitizeNameProcessor)
+	RegisterProcessor("rename", newRenameProcessor)
+	RegisterProcessor("copy", newCopyProcessor)
+	RegisterProcessor("filter", newFilterProcessor)
+	RegisterProcessor("sample", newSampleProcessor)
+}
+
+// Appends DogStatsD tags to every metric
+// options: {"tags": ["env:prod"]}
+func newAddTagsProcessor(options json.RawMessage) (Processor, error) {
+	var config struct {
+		Tags []string `json:"tags"`
+	}
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Tags) == 0 {
+		return nil, errors.New("tags are not set")
+	}
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		metric.AddTags(config.Tags...)
+		emit(metric)
+	}), nil
+}
+
+// Replaces characters other than letters, digits, '_', '-' and '.' in metric names
+// options: {"replacement": "_"}, "_" by default
+func newSanitizeNameProcessor(options json.RawMessage) (Processor, error) {
+	config := struct {
+		Replacement string `json:"replacement"`
+	}{Replacement: "_"}
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	invalid := regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		if invalid.MatchString(metric.name) {
+			metric.SetName(invalid.ReplaceAllLiteralString(metric.name, config.Replacement))
+		}
+		emit(metric)
+	}), nil
+}
+
+// Settings of processors which rename metrics
+type renameConfig struct {
+	// Regexp of the name
+	Pattern string `json:"pattern"`
+	// Replacement of matched parts, $1 and ${name} refer to submatches
+	Replacement string `json:"replacement"`
+}
+
+// Compiles the pattern
+func (config renameConfig) compile() (*regexp.Regexp, error) {
+	if config.Pattern == "" {
+		return nil, errors.New("pattern is not set")
+	}
+	return regexp.Compile(config.Pattern)
+}
+
+// Renames metrics which match the pattern, other metrics are not changed
+// options: {"pattern": "^apps\\.(\\w+)\\.", "replacement": "services.$1."}
+func newRenameProcessor(options json.RawMessage) (Processor, error) {
+	var config renameConfig
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	pattern, err := config.compile()
+	if err != nil {
+		return nil, err
+	}
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		if pattern.MatchString(metric.name) {
+			metric.SetName(pattern.ReplaceAllString(metric.name, config.Replacement))
+		}
+		emit(metric)
+	}), nil
+}
+
+// Emits every metric and, if it matches the pattern, its renamed copy
+// options are the same as options of rename processor
+func newCopyProcessor(options json.RawMessage) (Processor, error) {
+	var config renameConfig
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	pattern, err := config.compile()
+	if err != nil {
+		return nil, err
+	}
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		if pattern.MatchString(metric.name) {
+			clone := metric.Clone()
+			clone.SetName(pattern.ReplaceAllString(metric.name, config.Replacement))
+			emit(metric)
+			emit(clone)
+			return
+		}
+		emit(metric)
+	}), nil
+}
+
+// Keeps only metrics which match all set conditions or, with "drop": true, drops them
+// options: {"name": "regexp", "types": ["c", "ms"], "min": 0, "max": 1000, "drop": false}
+func newFilterProcessor(options json.RawMessage) (Processor, error) {
+	var config struct {
+		Name  string   `json:"name"`
+		Types []string `json:"types"`
+		Min   *float64 `json:"min"`
+		Max   *float64 `json:"max"`
+		Drop  bool     `json:"drop"`
+	}
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	var name *regexp.Regexp
+	if config.Name != "" {
+		var err error
+		if name, err = regexp.Compile(config.Name); err != nil {
+			return nil, err
+		}
+	}
+	types := make(map[string]bool, len(config.Types))
+	for _, metricType := range config.Types {
+		types[metricType] = true
+	}
+	matches := func(metric *StatsDMetric) bool {
+		switch {
+		case name != nil && !name.MatchString(metric.name):
+			return false
+		case len(types) > 0 && !types[metric.metricType]:
+			return false
+		case config.Min != nil && metric.value < *config.Min:
+			return false
+		case config.Max != nil && metric.value > *config.Max:
+			return false
+		}
+		return true
+	}
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		if matches(metric) != config.Drop {
+			emit(metric)
+		}
+	}), nil
+}
+
+// Forwards only a fraction of counters and timers and multiplies their sample rate by it,
+// gauges and sets are not sampled
+// options: {"rate": 0.1}
+func newSampleProcessor(options json.RawMessage) (Processor, error) {
+	var config struct {
+		Rate float64 `json:"rate"`
+	}
+	if err := unmarshalProcessorOptions(options, &config); err != nil {
+		return nil, err
+	}
+	if config.Rate <= 0 || config.Rate > 1 {
+		return nil, errors.New("rate has to be in (0, 1] range")
+	}
+	return ProcessorFunc(func(metric *StatsDMetric, emit func(*StatsDMetric)) {
+		if metric.metricType != "c" && metric.metricType != "ms" {
+			emit(metric)
+			return
+		}
+		if rand.Float64() >= config.Rate {
+			return
+		}
+		metric.scaleSampleRate(config.Rate)
+		emit(metric)
+	}), nil
+}
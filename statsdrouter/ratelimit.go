@@ -0,0 +1,235 @@
+// Token bucket rate limits of metric lines
+package statsdrouter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens with lines over the limit
+const (
+	// lines are dropped
+	RateLimitActionDrop = "drop"
+	// lines are sampled down and @rate of counters and timers is rewritten
+	RateLimitActionSample = "sample"
+)
+
+// Rate limit settings
+// exactly one of Rule and Prefix has to be set
+type RateLimitConfig struct {
+	// Rule whose backends are limited, other rules and the master host are not affected
+	Rule string `json:"rule,omitempty"`
+	// Metric name prefix, metrics are limited before routing
+	// when several prefixes match, the longest one is used
+	Prefix string `json:"prefix,omitempty"`
+	// Lines per second
+	Rate float64 `json:"rate"`
+	// Max lines passed at once after a quiet period, Rate by default
+	Burst int `json:"burst,omitempty"`
+	// One of RateLimitAction* constants, drop by default
+	Action string `json:"action,omitempty"`
+}
+
+// Returns limiter key in rule:<rule> or prefix:<prefix> format
+func (config RateLimitConfig) Key() string {
+	if config.Rule != "" {
+		return "rule:" + config.Rule
+	}
+	return "prefix:" + config.Prefix
+}
+
+// Checks settings and fills defaults
+// returns settings and an error
+func (config RateLimitConfig) normalize() (RateLimitConfig, error) {
+	if (config.Rule == "") == (config.Prefix == "") {
+		return config, errors.New("exactly one of rule and prefix has to be set")
+	}
+	if config.Rate <= 0 {
+		return config, errors.New("rate has to be positive")
+	}
+	if config.Burst <= 0 {
+		config.Burst = int(math.Ceil(config.Rate))
+	}
+	switch config.Action {
+	case "":
+		config.Action = RateLimitActionDrop
+	case RateLimitActionDrop, RateLimitActionSample:
+	default:
+		return config, fmt.Errorf("unknown rate limit action %q", config.Action)
+	}
+	return config, nil
+}
+
+// Token bucket of one rate limit
+type RateLimiter struct {
+	Config RateLimitConfig
+	Stats  struct {
+		// Lines passed unchanged
+		Allowed atomic.Uint64
+		// Lines over the limit which were passed with rewritten sample rate
+		Sampled atomic.Uint64
+		// Lines over the limit which were dropped
+		Dropped atomic.Uint64
+	}
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	// lines seen in the current and the previous second, they give sampling probability
+	second        int64
+	count         float64
+	previousCount float64
+}
+
+// Creates a new RateLimiter struct with a full bucket
+// accepts rate limit settings as parameter
+// returns the *RateLimiter struct and an error
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	config, err := config.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{Config: config, tokens: float64(config.Burst), last: time.Now()}, nil
+}
+
+// Takes a token for the metric
+// over the limit the metric is dropped or, with sample action, passed with probability
+// rate / observed rate and its sample rate is multiplied by this probability
+// returns false if the metric has to be dropped
+func (limiter *RateLimiter) Allow(metric *StatsDMetric) bool {
+	return limiter.allow(metric, time.Now())
+}
+
+// Takes a token for the metric at the given time
+func (limiter *RateLimiter) allow(metric *StatsDMetric, now time.Time) bool {
+	limiter.lock.Lock()
+	if second := now.Unix(); second != limiter.second {
+		limiter.previousCount = 0
+		if second == limiter.second+1 {
+			limiter.previousCount = limiter.count
+		}
+		limiter.second = second
+		limiter.count = 0
+	}
+	limiter.count++
+	limiter.tokens = math.Min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.Config.Rate, float64(limiter.Config.Burst))
+	limiter.last = now
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		limiter.lock.Unlock()
+		limiter.Stats.Allowed.Add(1)
+		return true
+	}
+	observed := math.Max(limiter.count, limiter.previousCount)
+	limiter.lock.Unlock()
+
+	if limiter.Config.Action == RateLimitActionDrop {
+		limiter.Stats.Dropped.Add(1)
+		return false
+	}
+	probability := math.Min(limiter.Config.Rate/observed, 1)
+	if rand.Float64() >= probability {
+		limiter.Stats.Dropped.Add(1)
+		return false
+	}
+	metric.scaleSampleRate(probability)
+	limiter.Stats.Sampled.Add(1)
+	return true
+}
+
+// Same as Allow, but doesn't take a token and doesn't count the metric
+// a metric over the limit with sample action passes with the sample rate it would get
+// returns the decision and its description, empty within the limit
+func (limiter *RateLimiter) explain(metric *StatsDMetric) (bool, string) {
+	probability := limiter.peek(time.Now())
+	switch probability {
+	case 1:
+		return true, ""
+	case 0:
+		return false, "over rate limit " + limiter.Config.Key()
+	}
+	metric.scaleSampleRate(probability)
+	return true, fmt.Sprintf("over rate limit %s, passed with probability %s", limiter.Config.Key(), formatValue(probability))
+}
+
+// Returns the probability a metric would pass with at the given time:
+// 1 within the limit, 0 if it would be dropped and rate / observed rate with sample action
+func (limiter *RateLimiter) peek(now time.Time) float64 {
+	limiter.lock.Lock()
+	count, previousCount := limiter.count+1, limiter.previousCount
+	if second := now.Unix(); second != limiter.second {
+		count, previousCount = 1, 0
+		if second == limiter.second+1 {
+			previousCount = limiter.count
+		}
+	}
+	tokens := math.Min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.Config.Rate, float64(limiter.Config.Burst))
+	limiter.lock.Unlock()
+	if tokens >= 1 {
+		return 1
+	}
+	if limiter.Config.Action == RateLimitActionDrop {
+		return 0
+	}
+	return math.Min(limiter.Config.Rate/math.Max(count, previousCount), 1)
+}
+
+// Active rate limiters
+type rateLimits struct {
+	// sorted by prefix length, the longest first
+	prefixes []*RateLimiter
+	rules    map[string]*RateLimiter
+}
+
+// Creates rate limiters
+// accepts rate limit settings
+// returns *rateLimits and an error
+func newRateLimits(configs []RateLimitConfig) (*rateLimits, error) {
+	limits := &rateLimits{rules: make(map[string]*RateLimiter)}
+	keys := make(map[string]bool, len(configs))
+	for i, config := range configs {
+		limiter, err := NewRateLimiter(config)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %d: %w", i, err)
+		}
+		if keys[config.Key()] {
+			return nil, fmt.Errorf("rate limit %d: duplicate %s", i, config.Key())
+		}
+		keys[config.Key()] = true
+		if config.Rule != "" {
+			limits.rules[config.Rule] = limiter
+		} else {
+			limits.prefixes = append(limits.prefixes, limiter)
+		}
+	}
+	sort.SliceStable(limits.prefixes, func(i, j int) bool {
+		return len(limits.prefixes[i].Config.Prefix) > len(limits.prefixes[j].Config.Prefix)
+	})
+	return limits, nil
+}
+
+// Returns limiter of the longest prefix of the name or nil
+func (limits *rateLimits) forName(name string) *RateLimiter {
+	for _, limiter := range limits.prefixes {
+		if strings.HasPrefix(name, limiter.Config.Prefix) {
+			return limiter
+		}
+	}
+	return nil
+}
+
+// Returns all limiters sorted by their keys
+func (limits *rateLimits) all() []*RateLimiter {
+	limiters := append([]*RateLimiter(nil), limits.prefixes...)
+	for _, limiter := range limits.rules {
+		limiters = append(limiters, limiter)
+	}
+	sort.Slice(limiters, func(i, j int) bool { return limiters[i].Config.Key() < limiters[j].Config.Key() })
+	return limiters
+}
@@ -0,0 +1,134 @@
+package statsdrouter
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, config RateLimitConfig, now time.Time) *RateLimiter {
+	t.Helper()
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		t.Fatalf("NewRateLimiter failed: %v", err)
+	}
+	limiter.last = now
+	return limiter
+}
+
+// Sends count lines at the given time and returns the number of allowed ones
+func allowLines(limiter *RateLimiter, count int, now time.Time) int {
+	allowed := 0
+	for i := 0; i < count; i++ {
+		if limiter.allow(&StatsDMetric{name: "app.hits", metricType: "c", value: 1, valueText: "1"}, now) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(t, RateLimitConfig{Prefix: "app.", Rate: 10, Burst: 5}, start)
+
+	if allowed := allowLines(limiter, 20, start); allowed != 5 {
+		t.Fatalf("full bucket allowed %d lines, want burst 5", allowed)
+	}
+	// 0.3s give 3 tokens
+	if allowed := allowLines(limiter, 20, start.Add(300*time.Millisecond)); allowed != 3 {
+		t.Fatalf("allowed %d lines after 300ms, want 3", allowed)
+	}
+	// the bucket never holds more than burst
+	if allowed := allowLines(limiter, 20, start.Add(time.Minute)); allowed != 5 {
+		t.Fatalf("allowed %d lines after a quiet minute, want burst 5", allowed)
+	}
+	if got := limiter.Stats.Allowed.Load(); got != 13 {
+		t.Fatalf("Allowed stat %d, want 13", got)
+	}
+	if got := limiter.Stats.Dropped.Load(); got != 47 {
+		t.Fatalf("Dropped stat %d, want 47", got)
+	}
+}
+
+func TestRateLimiterSteadyRate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(t, RateLimitConfig{Prefix: "app.", Rate: 100}, start)
+	allowLines(limiter, 100, start)
+
+	// 1000 lines per second for 5 seconds pass at the rate of 100 per second
+	allowed := 0
+	for i := 1; i <= 5000; i++ {
+		allowed += allowLines(limiter, 1, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if allowed < 499 || allowed > 501 {
+		t.Fatalf("allowed %d lines in 5 seconds, want 500", allowed)
+	}
+}
+
+func TestRateLimiterSampleAction(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(t, RateLimitConfig{Prefix: "app.", Rate: 100, Action: RateLimitActionSample}, start)
+	// the first second uses the burst and sets the observed rate to 1000 lines per second
+	allowLines(limiter, 1000, start)
+
+	passed := 0
+	for i := 0; i < 1000; i++ {
+		metric := &StatsDMetric{name: "app.hits", metricType: "c", value: 1, valueText: "1"}
+		if !limiter.allow(metric, start.Add(time.Second+time.Duration(i)*time.Millisecond)) {
+			continue
+		}
+		passed++
+		if rate := metric.SampleRate(); rate != 1 && rate != 0.1 {
+			t.Fatalf("sampled metric has sample rate %v, want 1 or 0.1", rate)
+		}
+	}
+	// about 200 lines with tokens (the refilled burst and the rate) and 10% of the others
+	if passed < 230 || passed > 330 {
+		t.Fatalf("passed %d lines of 1000, want about 280", passed)
+	}
+	if limiter.Stats.Sampled.Load() == 0 {
+		t.Fatal("no line was sampled")
+	}
+}
+
+func TestRateLimitsLongestPrefix(t *testing.T) {
+	limits, err := newRateLimits([]RateLimitConfig{
+		{Prefix: "app.", Rate: 10},
+		{Prefix: "app.api.", Rate: 5},
+		{Rule: "^app", Rate: 1},
+	})
+	if err != nil {
+		t.Fatalf("newRateLimits failed: %v", err)
+	}
+	tests := map[string]string{
+		"app.api.requests": "prefix:app.api.",
+		"app.db.queries":   "prefix:app.",
+		"other.metric":     "",
+	}
+	for name, want := range tests {
+		got := ""
+		if limiter := limits.forName(name); limiter != nil {
+			got = limiter.Config.Key()
+		}
+		if got != want {
+			t.Errorf("forName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if limits.rules["^app"] == nil {
+		t.Error("rule limiter is missing")
+	}
+}
+
+func TestRateLimitsInvalidConfigs(t *testing.T) {
+	tests := map[string][]RateLimitConfig{
+		"no rule and prefix": {{Rate: 1}},
+		"rule and prefix":    {{Rule: "^a", Prefix: "a", Rate: 1}},
+		"zero rate":          {{Prefix: "a", Rate: 0}},
+		"unknown action":     {{Prefix: "a", Rate: 1, Action: "queue"}},
+		"duplicate":          {{Prefix: "a", Rate: 1}, {Prefix: "a", Rate: 2}},
+	}
+	for name, configs := range tests {
+		if _, err := newRateLimits(configs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
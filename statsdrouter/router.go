@@ -2,213 +2,1126 @@
 package statsdrouter
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// TODO: Convert these consts to some kind of parameters
-const (
-	ChannelSize = 4
-	WorkerCount = 4
-)
-
-// Debug?
-var DebugMode bool
-
-// Should we print internal stats to the console?
-var PrintStats bool
+// Default time of draining and flushing metrics on shutdown
+const DefaultShutdownTimeout = 10 * time.Second
 
-// Counter for packets
-var Count float32 = 0
+// Received UDP packet
+type statsDPacket struct {
+	data   []byte
+	source *net.UDPAddr
+}
 
 // StatsD Metric struct
 type StatsDMetric struct {
-	name  string
-	value float64
-	raw   []byte
+	name       string
+	value      float64
+	valueText  string
+	metricType string
+	// 0 if the metric has no sample rate
+	sampleRate float64
+	tags       []string
+	// unknown fields, they are kept as is
+	extra []string
+	// nil when the metric was modified and has to be formatted again
+	raw    []byte
+	source *net.UDPAddr
+	err    error
 }
 
-// Starts a new router
-// returns an error
-func StartRouter(bindAddress string, port uint16, apiPort uint16, masterHost StatsdNode, configPath string, checkInterval int64, quit chan bool) error {
-	config, err := NewConfig(configPath)
+// Returns metric name
+func (metric *StatsDMetric) Name() string {
+	return metric.name
+}
+
+// Returns metric type: c, ms, g or s
+func (metric *StatsDMetric) Type() string {
+	return metric.metricType
+}
+
+// Returns metric value, it is 0 if the value is not a number (e.g. for sets)
+func (metric *StatsDMetric) Value() float64 {
+	return metric.value
+}
+
+// Returns sample rate of the metric, 1 if it is not set
+func (metric *StatsDMetric) SampleRate() float64 {
+	if metric.sampleRate == 0 {
+		return 1
+	}
+	return metric.sampleRate
+}
+
+// Returns tags of the metric in DogStatsD format (key:value or key)
+func (metric *StatsDMetric) Tags() []string {
+	return metric.tags
+}
+
+// Changes metric name
+func (metric *StatsDMetric) SetName(name string) {
+	metric.name = name
+	metric.raw = nil
+}
+
+// Changes metric value
+func (metric *StatsDMetric) SetValue(value float64) {
+	metric.value = value
+	metric.valueText = strconv.FormatFloat(value, 'f', -1, 64)
+	metric.raw = nil
+}
+
+// Changes sample rate of the metric, rate 1 or greater removes it
+func (metric *StatsDMetric) SetSampleRate(rate float64) {
+	if rate >= 1 {
+		rate = 0
+	}
+	metric.sampleRate = rate
+	metric.raw = nil
+}
+
+// Multiplies sample rate of counters and timers by the probability they were sampled with,
+// so StatsD still computes correct totals; gauges and sets don't have sample rate
+func (metric *StatsDMetric) scaleSampleRate(probability float64) {
+	if metric.metricType == "c" || metric.metricType == "ms" {
+		metric.SetSampleRate(metric.SampleRate() * probability)
+	}
+}
+
+// Replaces tags of the metric
+func (metric *StatsDMetric) SetTags(tags []string) {
+	metric.tags = tags
+	metric.raw = nil
+}
+
+// Appends tags to the metric
+func (metric *StatsDMetric) AddTags(tags ...string) {
+	metric.SetTags(append(metric.tags[:len(metric.tags):len(metric.tags)], tags...))
+}
+
+// Returns a copy of the metric which can be changed independently
+func (metric *StatsDMetric) Clone() *StatsDMetric {
+	clone := *metric
+	clone.tags = append([]string(nil), metric.tags...)
+	clone.extra = append([]string(nil), metric.extra...)
+	return &clone
+}
+
+// Returns metric line, it is the received one unless the metric was modified
+func (metric *StatsDMetric) Raw() []byte {
+	if metric.raw == nil {
+		metric.raw = metric.format()
+	}
+	return metric.raw
+}
+
+// Formats metric line from its fields
+func (metric *StatsDMetric) format() []byte {
+	line := make([]byte, 0, len(metric.name)+len(metric.valueText)+8)
+	line = append(line, metric.name...)
+	line = append(line, ':')
+	line = append(line, metric.valueText...)
+	line = append(line, '|')
+	line = append(line, metric.metricType...)
+	if metric.sampleRate != 0 {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, metric.sampleRate, 'f', -1, 64)
+	}
+	if len(metric.tags) > 0 {
+		line = append(line, "|#"...)
+		line = append(line, strings.Join(metric.tags, ",")...)
+	}
+	for _, part := range metric.extra {
+		line = append(line, '|')
+		line = append(line, part...)
+	}
+	return line
+}
+
+// Returns address metric was received from, nil for injected metrics
+func (metric *StatsDMetric) Source() *net.UDPAddr {
+	return metric.source
+}
+
+// Callbacks of router events, nil ones are not called
+// they are called synchronously on the data path and must be fast
+type Hooks struct {
+	// Called for every parsed metric before routing, the metric is dropped if it returns false
+	OnMetric func(metric *StatsDMetric) bool
+	// Called for every routing decision
+	OnRoute RouteFunc
+	// Called when a backend becomes alive or dead
+	OnBackendHealthChange func(backend *StatsDBackend, alive bool)
+}
+
+// Router settings
+type RouterOptions struct {
+	// Address and port of StatsD UDP listener, port 0 disables the listener
+	BindAddress string
+	Port        uint16
+	// Port of API server, 0 disables the server (handlers can still be mounted with RegisterHandlers)
+	APIPort uint16
+	// Host that receives all metrics
+	MasterHost StatsdNode
+	// Config file, it is created if it doesn't exist and rewritten when rules or modes change
+	ConfigPath string
+	// Config used instead of ConfigPath, it is kept in memory only if its FilePath is empty
+	Config *RouterConfig
+	// Pipeline settings, values set here take precedence over the config file
+	Pipeline PipelineConfig
+	// Settings of backends
+	Backend BackendOptions
+	// Internal metrics sender settings
+	InternalMetrics InternalMetricsConfig
+	// Max time of draining and flushing metrics on shutdown, DefaultShutdownTimeout if 0
+	ShutdownTimeout time.Duration
+	// Print received packets rate to stdout
+	PrintStats bool
+	// Logging of the router, logfmt at info level to stderr if nil
+	Logging *Logging
+	Hooks   Hooks
+}
+
+// Router struct
+// it owns the routing map, backends and API server and runs the listener pipeline
+type Router struct {
+	options       RouterOptions
+	pipeline      PipelineConfig
+	config        *RouterConfig
+	stats         *RouterStats
+	routingMap    *RoutingMap
+	masterBackend *StatsDBackend
+	taps          *Taps
+	// global processor chain
+	processors atomic.Pointer[[]Processor]
+	rateLimits atomic.Pointer[rateLimits]
+	// limits of distinct names
+	cardinalityLimits atomic.Pointer[cardinalityLimits]
+	aggregations      atomic.Pointer[aggregations]
+	// held for reading while metrics are added to aggregators and for writing while they are replaced
+	aggregationsLock sync.RWMutex
+	// serializes changes of rules, so the routing map, the config and limits are changed together
+	updateLock sync.Mutex
+	api        *HttpApi
+	logging    *Logging
+	logger     *slog.Logger
+	// logs malformed metrics of all packet handlers
+	malformedLogger *RateLimitedLogger
+	// logs names over cardinality limits
+	cardinalityLogger *RateLimitedLogger
+	lock              sync.Mutex
+	// set while Run is running
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed bool
+}
+
+// Creates a new Router struct: reads the config, creates backends and the API
+// nothing is listening until Run is called
+// accepts RouterOptions as parameter
+// returns the *Router struct and an error
+func NewRouter(options RouterOptions) (*Router, error) {
+	if options.Logging == nil {
+		logging, err := NewLogging(os.Stderr, LogFormatLogfmt, slog.LevelInfo)
+		if err != nil {
+			return nil, err
+		}
+		options.Logging = logging
+	}
+	if options.ShutdownTimeout <= 0 {
+		options.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	logging := options.Logging
+	logger := logging.Logger(ComponentRouter)
+	config := options.Config
+	if config == nil && options.ConfigPath != "" {
+		var err error
+		config, err = NewConfig(options.ConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config file: %w", err)
+		}
+	}
+	if config == nil {
+		config = &RouterConfig{}
+	}
+	if config.Rules == nil {
+		config.Rules = make(map[string][]StatsdNode)
+	}
+	// options take precedence over the config file
+	pipeline := DefaultPipelineConfig()
+	if config.Pipeline != nil {
+		pipeline = pipeline.Override(*config.Pipeline)
+	}
+	pipeline = pipeline.Override(options.Pipeline)
+	logger.Info("Using pipeline settings", "pipeline", fmt.Sprintf("%+v", pipeline))
+	backendOptions := options.Backend
+	backendOptions.QueueSize = pipeline.QueueSize
+	backendOptions.Senders = pipeline.Senders
+	if options.Hooks.OnBackendHealthChange != nil {
+		backendOptions.OnHealthChange = options.Hooks.OnBackendHealthChange
+	}
+	// persisted modes are applied to backends when they are created, discovered ones included
+	backendOptions.InitialMode = config.BackendMode
+
+	if err := config.checkGraphiteNodes(options.MasterHost, nil); err != nil {
+		return nil, err
+	}
+	processors, err := NewProcessors(config.Processors)
 	if err != nil {
-		log.Printf("Error parsing config file: %s (exiting...)", err)
-		return err
+		return nil, fmt.Errorf("failed to create processors: %w", err)
+	}
+	limits, err := newRateLimits(config.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rate limits: %w", err)
+	}
+	cardinality, err := newCardinalityLimits(config.CardinalityLimits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cardinality limits: %w", err)
+	}
+	aggregations, err := newAggregations(config.Aggregation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aggregations: %w", err)
 	}
 
-	masterBackend, err := NewStatsDBackend(masterHost.Host, masterHost.Port, masterHost.ManagementPort, checkInterval)
+	masterBackend, err := NewStatsDBackend(options.MasterHost, backendOptions, logging.Logger(ComponentBackend))
 	if err != nil {
-		log.Printf("Failed to create master backend: %s", err)
+		return nil, fmt.Errorf("failed to create master backend: %w", err)
+	}
+	router := &Router{
+		options:           options,
+		pipeline:          pipeline,
+		config:            config,
+		stats:             NewRouterStats(),
+		routingMap:        NewRoutingMap(backendOptions, logging),
+		masterBackend:     masterBackend,
+		taps:              NewTaps(),
+		logging:           logging,
+		logger:            logger,
+		malformedLogger:   NewRateLimitedLogger(logging.Logger(ComponentListener), 10*time.Second),
+		cardinalityLogger: NewRateLimitedLogger(logging.Logger(ComponentRouting), 10*time.Second),
+	}
+	router.processors.Store(&processors)
+	router.rateLimits.Store(limits)
+	router.cardinalityLimits.Store(&cardinality)
+	router.aggregations.Store(aggregations)
+	if err = router.routingMap.UpdateRoutingMap(config); err != nil {
+		router.closeBackends(context.Background())
+		return nil, fmt.Errorf("failed to populate routing map: %w", err)
+	}
+	router.api = NewHttpApi(options.APIPort, router)
+	return router, nil
+}
+
+// Returns rate limiters sorted by their keys
+func (router *Router) RateLimiters() []*RateLimiter {
+	return router.rateLimits.Load().all()
+}
+
+// Returns cardinality limiters, the ones with the longest prefixes first
+func (router *Router) CardinalityLimiters() []*CardinalityLimiter {
+	return *router.cardinalityLimits.Load()
+}
+
+// Returns groups of cardinality limiters with most distinct names
+// accepts max number of groups, 0 means all of them
+func (router *Router) TopCardinalityGroups(count int) []CardinalityGroupStatus {
+	return router.cardinalityLimits.Load().topGroups(count)
+}
+
+// Returns aggregator of the master backend or nil if it is not aggregated
+func (router *Router) MasterAggregator() *Aggregator {
+	return router.aggregations.Load().master
+}
+
+// Returns aggregators of rules
+func (router *Router) RuleAggregators() map[string]*Aggregator {
+	return router.aggregations.Load().rules
+}
+
+// Returns counters of the router
+func (router *Router) Stats() *RouterStats {
+	return router.stats
+}
+
+// Returns the routing map of the router
+func (router *Router) RoutingMap() *RoutingMap {
+	return router.routingMap
+}
+
+// Returns the master backend
+func (router *Router) MasterBackend() *StatsDBackend {
+	return router.masterBackend
+}
+
+// Returns the master or a rule's backend by its key or nil if there is no such backend
+func (router *Router) Backend(backendKey string) *StatsDBackend {
+	if backendKey == router.masterBackend.Key() {
+		return router.masterBackend
+	}
+	return router.routingMap.Backend(backendKey)
+}
+
+// Adds rules and their backends, existing rules get new backends only
+// the config file is rewritten; everything is checked and saved before it is applied,
+// so a failed update changes neither the routing nor the config
+// accepts a *RouterConfig with rules to add
+// returns an error
+func (router *Router) UpdateRules(newConfig *RouterConfig) error {
+	router.updateLock.Lock()
+	defer router.updateLock.Unlock()
+	if err := router.config.checkGraphiteNodes(router.options.MasterHost, newConfig); err != nil {
+		router.stats.ConfigReloadsFailed.Add(1)
 		return err
 	}
-	routingMap := NewRoutingMap(checkInterval)
-	err = routingMap.UpdateRoutingMap(config)
+	var processors []Processor
+	if newConfig.Processors != nil {
+		var err error
+		if processors, err = NewProcessors(newConfig.Processors); err != nil {
+			router.stats.ConfigReloadsFailed.Add(1)
+			return fmt.Errorf("failed to create processors: %w", err)
+		}
+	}
+	var limits *rateLimits
+	if newConfig.RateLimits != nil {
+		var err error
+		if limits, err = newRateLimits(newConfig.RateLimits); err != nil {
+			router.stats.ConfigReloadsFailed.Add(1)
+			return fmt.Errorf("failed to create rate limits: %w", err)
+		}
+	}
+	var cardinality cardinalityLimits
+	if newConfig.CardinalityLimits != nil {
+		var err error
+		if cardinality, err = newCardinalityLimits(newConfig.CardinalityLimits); err != nil {
+			router.stats.ConfigReloadsFailed.Add(1)
+			return fmt.Errorf("failed to create cardinality limits: %w", err)
+		}
+	}
+	var replacement *aggregations
+	if newConfig.Aggregation != nil {
+		var err error
+		if replacement, err = newAggregations(newConfig.Aggregation); err != nil {
+			router.stats.ConfigReloadsFailed.Add(1)
+			return fmt.Errorf("failed to create aggregations: %w", err)
+		}
+	}
+	update, err := router.routingMap.prepareUpdate(newConfig)
 	if err != nil {
-		log.Printf("Failed to populate routing map: %s", err)
+		router.stats.ConfigReloadsFailed.Add(1)
+		return fmt.Errorf("failed to update routing map: %w", err)
+	}
+	if err := router.config.UpdateConfig(newConfig); err != nil {
+		router.routingMap.discardUpdate(update)
+		router.stats.ConfigReloadsFailed.Add(1)
+		return fmt.Errorf("failed to update config: %w", err)
+	}
+	router.routingMap.applyUpdate(update)
+	if newConfig.Processors != nil {
+		router.processors.Store(&processors)
+	}
+	if limits != nil {
+		router.rateLimits.Store(limits)
+	}
+	if newConfig.CardinalityLimits != nil {
+		router.cardinalityLimits.Store(&cardinality)
+	}
+	if replacement != nil {
+		router.aggregationsLock.Lock()
+		replaced := router.aggregations.Swap(replacement)
+		router.aggregationsLock.Unlock()
+		// metrics are added under the read lock, so nothing is added to replaced aggregators anymore
+		// and metrics aggregated by them are sent right away
+		router.flushAggregations(replaced, nil)
+	}
+	router.stats.ConfigReloadsSucceeded.Add(1)
+	router.logger.Info("Config was updated", "rules", router.config.RulesCount())
+	return nil
+}
+
+// Replaces the global processor chain, including processors from the config
+// accepts processors in chain order, no processors remove the chain
+func (router *Router) SetProcessors(processors ...Processor) {
+	router.processors.Store(&processors)
+}
+
+// Replaces processor chain of the rule, including processors from the config
+// accepts a rule and processors in chain order, no processors remove the chain
+// returns an error if there is no such rule
+func (router *Router) SetRuleProcessors(rule string, processors ...Processor) error {
+	return router.routingMap.SetRuleProcessors(rule, processors...)
+}
+
+// Adds a rule with backends of the nodes or adds the backends to an existing rule
+// returns an error
+func (router *Router) AddRule(rule string, nodes ...StatsdNode) error {
+	return router.UpdateRules(&RouterConfig{Rules: map[string][]StatsdNode{rule: nodes}})
+}
+
+// Adds a backend of the node to the rule, the rule is created if it doesn't exist
+// returns an error
+func (router *Router) AddBackend(rule string, node StatsdNode) error {
+	return router.AddRule(rule, node)
+}
+
+// Removes the rule, its discoveries and backends which are not used by other rules
+// returns an error
+func (router *Router) RemoveRule(rule string) error {
+	router.updateLock.Lock()
+	defer router.updateLock.Unlock()
+	if err := router.routingMap.RemoveRule(rule); err != nil {
+		return err
+	}
+	if err := router.config.RemoveRule(rule); err != nil {
+		return fmt.Errorf("failed to update config: %w", err)
+	}
+	router.logger.Info("Rule was removed", "rule", rule)
+	return nil
+}
+
+// Removes the node from the rule, the node is a backend key or a discovery key (type:name)
+// the backend is closed if no other rule uses it
+// returns an error
+func (router *Router) RemoveBackend(rule string, nodeKey string) error {
+	router.updateLock.Lock()
+	defer router.updateLock.Unlock()
+	if err := router.routingMap.RemoveNode(rule, nodeKey); err != nil {
 		return err
 	}
+	if err := router.config.RemoveNode(rule, nodeKey); err != nil {
+		return fmt.Errorf("failed to update config: %w", err)
+	}
+	router.logger.Info("Backend was removed from rule", "rule", rule, "backend", nodeKey)
+	return nil
+}
 
-	api := NewHttpApi(apiPort, config, routingMap)
-	go api.Start()
+// Parses newline separated metrics and routes them as if they were received by the listener
+// metrics are routed synchronously, so blocking overflow policy may block the caller
+// returns an error for every malformatted line
+func (router *Router) InjectMetrics(data []byte) error {
+	var errs []error
+	for _, metric := range router.parse(data, nil) {
+		if metric.err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", metric.raw, metric.err))
+			continue
+		}
+		router.routeMetric(metric, nil)
+	}
+	return errors.Join(errs...)
+}
+
+// Mounts API handlers on the mux, see HttpApi.RegisterHandlers
+func (router *Router) RegisterHandlers(mux *http.ServeMux) {
+	router.api.RegisterHandlers(mux)
+}
+
+// Runs the listener, the API server and the internal metrics sender until ctx is done
+// or one of them fails, then stops accepting metrics, drains channels and flushes
+// backend queues, spending at most ShutdownTimeout on it
+// the router can't be run again after Run returns
+// returns an error of the failed component
+func (router *Router) Run(ctx context.Context) error {
+	router.lock.Lock()
+	if router.closed || router.done != nil {
+		router.lock.Unlock()
+		return errors.New("router is already running or closed")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	router.cancel = cancel
+	router.done = make(chan struct{})
+	router.lock.Unlock()
+	defer close(router.done)
+	defer cancel()
+
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+	run := func(component string, f func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				errs <- fmt.Errorf("%s failed: %w", component, err)
+				cancel()
+			}
+		}()
+	}
+	if router.options.APIPort != 0 {
+		run(ComponentApi, router.api.Run)
+	}
+	if router.options.Port != 0 {
+		run(ComponentListener, router.listen)
+	}
+	run(ComponentRouting, router.runAggregations)
+	run(ComponentMetrics, router.runInternalMetrics)
+
+	<-ctx.Done()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), router.options.ShutdownTimeout)
+	defer cancelShutdown()
+	router.logger.Info("Draining router pipeline...", "timeout", router.options.ShutdownTimeout)
+	if !waitWithContext(shutdownCtx, &wg) {
+		router.logger.Warn("Router pipeline was not drained before shutdown deadline")
+	}
+	router.flushAggregations(router.aggregations.Load(), nil)
+	router.lock.Lock()
+	router.closed = true
+	router.lock.Unlock()
+	router.closeBackends(shutdownCtx)
+	router.logger.Info("Router terminated")
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Stops discoveries and closes all backends in parallel
+// backends flush their queues until ctx is done
+func (router *Router) closeBackends(ctx context.Context) {
+	router.logger.Info("Shutting down all backends objects...")
+	router.routingMap.Close()
+	backends := append([]*StatsDBackend{router.masterBackend}, router.routingMap.Backends()...)
 	var wg sync.WaitGroup
-	go StartMainListener(bindAddress, port, routingMap, masterBackend, quit, &wg)
-	// TODO: Add some internal metrics sender goroutine
-
-	// wait for quit signal
-	<-quit
-	log.Println("Shuting down all backends objects...")
-	wg.Add(1)
-	go masterBackend.Exit(&wg)
-	for _, backend := range routingMap.backendList {
+	for _, backend := range backends {
 		wg.Add(1)
-		go backend.Exit(&wg)
+		go func(backend *StatsDBackend) {
+			defer wg.Done()
+			if err := backend.Close(ctx); err != nil {
+				router.logger.Warn("Failed to close backend", "backend", backend.Key(), "error", err)
+			}
+		}(backend)
 	}
 	wg.Wait()
-	log.Println("Terminating StartRouter goroutine")
+}
+
+// Stops the router and waits until it is shut down
+// backends are closed right away if the router was never run
+// returns an error
+func (router *Router) Close() error {
+	router.lock.Lock()
+	if router.done == nil {
+		if router.closed {
+			router.lock.Unlock()
+			return nil
+		}
+		router.closed = true
+		router.lock.Unlock()
+		router.closeBackends(context.Background())
+		return nil
+	}
+	cancel, done := router.cancel, router.done
+	router.lock.Unlock()
+	cancel()
+	<-done
 	return nil
 }
 
+// Creates and runs a new router until ctx is done
+// returns an error
+func StartRouter(ctx context.Context, options RouterOptions) error {
+	router, err := NewRouter(options)
+	if err != nil {
+		return err
+	}
+	return router.Run(ctx)
+}
+
+// Waits for the WaitGroup until ctx is done
+// returns false if ctx was done first
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // Sets up the main UDP listener
 // which will send recieved packets to packetHandler via channel
-func StartMainListener(bindAddress string, port uint16, routingMap *RoutingMap, masterBackend *StatsDBackend, quit chan bool, wg *sync.WaitGroup) error {
-	// TODO: Add quit?
-	log.Printf("Starting StatsD listener on %s and port %d", bindAddress, port)
+// When ctx is done it stops reading and returns after packet and metric handlers
+// have drained their channels
+// returns an error if the listener can't be set up
+func (router *Router) listen(ctx context.Context) error {
+	logger := router.logging.Logger(ComponentListener)
+	bindAddress, port, pipeline := router.options.BindAddress, router.options.Port, router.pipeline
+	logger.Info("Starting StatsD listener", "address", bindAddress, "port", port)
 
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", bindAddress, port))
 	if err != nil {
-		log.Printf("Error resolving UDP address [%s:%d]: %s (exiting...)", bindAddress, port, err)
-		return err
+		return fmt.Errorf("error resolving UDP address: %w", err)
 	}
 
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Printf("Error setting up listener: %s (exiting...)", err)
-		return err
+		return fmt.Errorf("error setting up listener: %w", err)
 	}
 	defer conn.Close()
 
-	packetsChannel := make(chan []byte, ChannelSize)
-	metricsChannel := make(chan *StatsDMetric, ChannelSize)
-	for i := 0; i < WorkerCount; i++ {
-		wg.Add(1)
-		go packetHandler(packetsChannel, metricsChannel, quit, wg)
+	packetsChannel := make(chan statsDPacket, pipeline.PacketChannelSize)
+	metricsChannel := make(chan *StatsDMetric, pipeline.MetricChannelSize)
+	var packetHandlersWG, metricHandlersWG sync.WaitGroup
+	for i := 0; i < pipeline.PacketHandlers; i++ {
+		packetHandlersWG.Add(1)
+		go router.packetHandler(packetsChannel, metricsChannel, logger, &packetHandlersWG)
 	}
 
-	for i := 0; i < WorkerCount; i++ {
-		wg.Add(1)
-		go metricHandler(routingMap, metricsChannel, masterBackend, quit, wg)
+	for i := 0; i < pipeline.MetricHandlers; i++ {
+		metricHandlersWG.Add(1)
+		go router.metricHandler(metricsChannel, logger, &metricHandlersWG)
 	}
-	timeout := float32(10.0)
-	tick := time.Tick(time.Duration(timeout) * time.Second)
+	readErrorLogger := NewRateLimitedLogger(logger, 10*time.Second)
+	timeout := 10.0
 	padding := strings.Repeat("-", 5)
-	// I tried to use channel, sync.Mutex, sync/atomic to make Count thread-safe
-	// but because of their slowness I finally agreed to lose some values...
-	if PrintStats {
+	if router.options.PrintStats {
 		go func() {
-			for _ = range tick {
-				fmt.Printf("%[2]s We got %[1]f packets - %[3]f packets/sec %[2]s\n", Count, padding, Count/timeout)
-				Count = 0
+			tick := time.NewTicker(time.Duration(timeout) * time.Second)
+			defer tick.Stop()
+			var lastCount uint64
+			for {
+				select {
+				case <-tick.C:
+				case <-ctx.Done():
+					return
+				}
+				count := router.stats.PacketsReceived.Load()
+				fmt.Printf("%[2]s We got %[1]d packets - %[3]f packets/sec %[2]s\n", count-lastCount, padding, float64(count-lastCount)/timeout)
+				lastCount = count
 			}
 		}()
 	}
+	// closing the connection interrupts ReadFromUDP
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+readLoop:
 	for {
 		buf := make([]byte, 1024)
 		packetLength, clientAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("read err: %s", err)
+			if ctx.Err() != nil {
+				break readLoop
+			}
+			readErrorLogger.Warn("Failed to read packet", "error", err)
 			continue
 		}
-		if DebugMode {
-			log.Printf("received data from=%s len=%d", clientAddr, packetLength)
+		if logger.Enabled(context.Background(), slog.LevelDebug) {
+			logger.Debug("Received data", "from", clientAddr, "length", packetLength)
 		}
-		if PrintStats {
-			Count++
-		}
-		packetsChannel <- buf[0:packetLength]
+		router.stats.PacketsReceived.Add(1)
+		packetsChannel <- statsDPacket{data: buf[0:packetLength], source: clientAddr}
 	}
-	log.Println("Terminating StartMainListener goroutine")
+	logger.Info("Stopped accepting metrics, draining channels", "packets", len(packetsChannel), "metrics", len(metricsChannel))
+	close(packetsChannel)
+	packetHandlersWG.Wait()
+	close(metricsChannel)
+	metricHandlersWG.Wait()
+	logger.Info("Terminating listener")
 	return nil
 }
 
 // Handles packets, creates metrics from them and sends them to metricHandler via channel
-func packetHandler(packetsChannel chan []byte, metricsChannel chan *StatsDMetric, quit chan bool, wg *sync.WaitGroup) {
+// returns when packetsChannel is closed and drained
+func (router *Router) packetHandler(packetsChannel chan statsDPacket, metricsChannel chan *StatsDMetric, logger *slog.Logger, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for {
-		select {
-		case packet := <-packetsChannel:
-			if DebugMode {
-				log.Printf("Got packet: %s", string(packet))
-			}
-			metrics := strings.Split(string(packet), "\n")
-			for _, metric := range metrics {
-				metric := parseMetric(metric)
+	for packet := range packetsChannel {
+		if logger.Enabled(context.Background(), slog.LevelDebug) {
+			logger.Debug("Got packet", "packet", string(packet.data), "from", packet.source)
+		}
+		for _, metric := range router.parse(packet.data, packet.source) {
+			if metric.err == nil {
 				metricsChannel <- metric
 			}
-		case <-quit:
-			log.Println("Terminating packetHandler goroutine")
-			return
 		}
 	}
+	logger.Debug("Terminating packetHandler goroutine")
+}
+
+// Parses a packet and counts its lines and parse errors
+// returns a slice of *StatsDMetric, malformatted ones have err set
+func (router *Router) parse(packet []byte, source *net.UDPAddr) []*StatsDMetric {
+	metrics := parsePacket(packet)
+	for _, metric := range metrics {
+		metric.source = source
+		router.stats.LinesReceived.Add(1)
+		if metric.err != nil {
+			router.stats.countParseError(metric.err)
+			router.malformedLogger.Warn("Malformatted metric", "metric", string(metric.raw), "error", metric.err)
+		}
+	}
+	return metrics
+}
+
+// Splits a packet into lines and parses each of them
+// empty lines are skipped, malformatted lines are returned with err set
+// returns a slice of *StatsDMetric
+func parsePacket(packet []byte) []*StatsDMetric {
+	var metrics []*StatsDMetric
+	for _, line := range strings.Split(string(packet), "\n") {
+		if line == "" {
+			continue
+		}
+		metric, err := parseMetric(line)
+		if err != nil {
+			metric = &StatsDMetric{raw: []byte(line), err: err}
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
 }
 
 // Parses a string into a statsd packet
-// accepts a string of data
-// returns a StatsDMetric
-func parseMetric(data string) *StatsDMetric {
+// accepts a string of data in name:value|type[|@sample_rate][|#tags] format
+// returns a StatsDMetric and an error
+func parseMetric(data string) (*StatsDMetric, error) {
 	metric := new(StatsDMetric)
-	metricParts := strings.Split(data, ":")
-	if len(metricParts) < 2 {
-		log.Printf("Malformatted metric: %s", data)
-		return metric
-	}
-	name := metricParts[0]
-	valueParts := strings.Split(metricParts[1], "|")
-	value64, _ := strconv.ParseInt(valueParts[0], 10, 0)
-	value := float64(value64)
+	separator := strings.IndexByte(data, ':')
+	if separator < 0 {
+		return nil, errNoValueSeparator
+	}
+	name := data[:separator]
+	valueParts := strings.Split(data[separator+1:], "|")
+	if len(valueParts) < 2 {
+		return nil, errNoTypeSeparator
+	}
+	value, _ := strconv.ParseFloat(valueParts[0], 64)
 	// check for a samplerate
 	typeParts := strings.Split(valueParts[1], "@")
 	metricType := typeParts[0]
 
 	switch metricType {
-	case "c", "ms", "g":
+	case "c", "ms", "g", "s":
 		metric.name = name
 		metric.value = value
+		metric.valueText = valueParts[0]
+		metric.metricType = metricType
 		metric.raw = []byte(data)
 	default:
-		log.Printf("Unknown metrics type: %s", metricType)
+		return nil, fmt.Errorf("%w %q", errUnknownType, metricType)
+	}
+	if len(typeParts) > 1 {
+		metric.sampleRate, _ = strconv.ParseFloat(typeParts[1], 64)
+	}
+	for _, part := range valueParts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			metric.sampleRate, _ = strconv.ParseFloat(part[1:], 64)
+		case strings.HasPrefix(part, "#"):
+			metric.tags = append(metric.tags, strings.Split(part[1:], ",")...)
+		default:
+			metric.extra = append(metric.extra, part)
+		}
 	}
 
-	return metric
+	return metric, nil
 }
 
-// Sends a metric to one of the active statsd backends
-func metricHandler(routingMap *RoutingMap, metricsChannel chan *StatsDMetric, masterBackend *StatsDBackend, quit chan bool, wg *sync.WaitGroup) {
+// Sends metrics to one of the active statsd backends
+// returns when metricsChannel is closed and drained
+func (router *Router) metricHandler(metricsChannel chan *StatsDMetric, logger *slog.Logger, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for {
-		select {
-		case metric := <-metricsChannel:
-			for _, rule := range routingMap.Map {
-				// find out to which backend send a metric
-				if rule.Regexp.MatchString(metric.name) {
-					for _, backend := range rule.Backends {
-						if backend.Status.Alive {
-							backend.SendChannel <- metric.raw
-						}
+	for metric := range metricsChannel {
+		router.routeMetric(metric, nil)
+	}
+	logger.Debug("Terminating metricHandler goroutine")
+}
+
+// Routing decisions recorded by a dry run of routeMetric
+type routeTrace struct {
+	routes []MetricRoute
+	// steps which changed the metric being routed, they are shown with its routes
+	notes []string
+}
+
+// Returns MetricRoute of the metric with current notes
+func (trace *routeTrace) metricRoute(metric *StatsDMetric) MetricRoute {
+	return MetricRoute{
+		Metric: string(metric.Raw()),
+		Name:   metric.name,
+		Notes:  append([]string(nil), trace.notes...),
+		Rules:  []RuleRoute{},
+	}
+}
+
+// Records a metric which doesn't reach any backend
+func (trace *routeTrace) drop(metric *StatsDMetric, reason string) {
+	route := trace.metricRoute(metric)
+	route.Dropped = reason
+	trace.routes = append(trace.routes, route)
+}
+
+// Returns BackendRoute of a routing decision
+func newBackendRoute(backend *StatsDBackend, send bool, reason string) BackendRoute {
+	return BackendRoute{Backend: backend.Key(), Alive: backend.Status().Alive, Mode: backend.Mode(), Send: send, Reason: reason}
+}
+
+// Applies prefix rate limit to a metric, passes it through the global processor chain
+// and sends resulting metrics to backends of matching rules and the master backend
+// with a trace it is a dry run: hooks are not called, limiters, aggregators and backends
+// are not changed and the decisions are recorded in the trace
+func (router *Router) routeMetric(metric *StatsDMetric, trace *routeTrace) {
+	if trace != nil {
+		trace.notes = nil
+	} else if onMetric := router.options.Hooks.OnMetric; onMetric != nil && !onMetric(metric) {
+		return
+	}
+	if limiter := router.rateLimits.Load().forName(metric.name); limiter != nil {
+		if trace == nil {
+			if !limiter.Allow(metric) {
+				return
+			}
+		} else if allowed, note := limiter.explain(metric); !allowed {
+			trace.drop(metric, note)
+			return
+		} else if note != "" {
+			trace.notes = append(trace.notes, note)
+		}
+	}
+	processors := *router.processors.Load()
+	if len(processors) == 0 {
+		router.limitCardinality(metric, trace)
+		return
+	}
+	emitted := runProcessors(processors, metric, func(processed *StatsDMetric) {
+		router.limitCardinality(processed, trace)
+	})
+	if emitted > 0 {
+		return
+	}
+	if trace != nil {
+		trace.drop(metric, "dropped by processors")
+		return
+	}
+	router.stats.ProcessorDrops.Add(1)
+}
+
+// Checks if a metric has a known name or its group has room for a new one
+// and dispatches it, new names over the limit are dropped, quarantined or renamed
+// a dry run only checks the name, it isn't recorded
+func (router *Router) limitCardinality(metric *StatsDMetric, trace *routeTrace) {
+	limiter := router.cardinalityLimits.Load().forName(metric.name)
+	if limiter == nil {
+		router.dispatchMetric(metric, trace)
+		return
+	}
+	var admitted bool
+	var group string
+	if trace == nil {
+		admitted, group = limiter.Admit(metric.name)
+	} else {
+		admitted, group = limiter.check(metric.name)
+	}
+	if admitted {
+		router.dispatchMetric(metric, trace)
+		return
+	}
+	if trace == nil {
+		router.cardinalityLogger.Warn("Metric name is over cardinality limit", "metric", metric.name, "group", group, "max_names", limiter.Config.MaxNames, "action", limiter.Config.Action)
+	}
+	switch limiter.Config.Action {
+	case CardinalityActionOverflow:
+		overflowName := limiter.overflowName(group)
+		if trace == nil {
+			metric.SetName(overflowName)
+			router.dispatchMetric(metric, trace)
+			return
+		}
+		notes := trace.notes
+		trace.notes = append(notes[:len(notes):len(notes)], fmt.Sprintf("renamed from %s, over cardinality limit of group %q", metric.name, group))
+		metric.SetName(overflowName)
+		router.dispatchMetric(metric, trace)
+		trace.notes = notes
+	case CardinalityActionQuarantine:
+		backend := router.Backend(limiter.Config.Backend)
+		if backend == nil {
+			if trace != nil {
+				trace.drop(metric, fmt.Sprintf("over cardinality limit of group %q, quarantine backend %s not found", group, limiter.Config.Backend))
+				return
+			}
+			router.cardinalityLogger.Warn("Quarantine backend not found, metric is dropped", "backend", limiter.Config.Backend, "metric", metric.name)
+			return
+		}
+		send, reason := backendDecision(backend)
+		if trace != nil {
+			route := trace.metricRoute(metric)
+			route.Notes = append(route.Notes, fmt.Sprintf("over cardinality limit of group %q, quarantined", group))
+			quarantine := newBackendRoute(backend, send, reason)
+			route.Quarantine = &quarantine
+			trace.routes = append(trace.routes, route)
+			return
+		}
+		router.sendMetric(backend, metric, send)
+	default:
+		if trace != nil {
+			trace.drop(metric, fmt.Sprintf("over cardinality limit of group %q", group))
+		}
+	}
+}
+
+// Sends a metric to backends of matching rules and the master backend
+// backends of rules with rate limits or processors receive metrics which passed the limit and the rule's chain,
+// metrics of aggregated rules and the master backend are added to their aggregators
+// a dry run records the decisions in the trace instead
+func (router *Router) dispatchMetric(metric *StatsDMetric, trace *routeTrace) {
+	onRoute := router.options.Hooks.OnRoute
+	limits := router.rateLimits.Load()
+	aggregations := router.aggregations.Load()
+	tapping := trace == nil && router.taps.Active()
+	var routes []TapRoute
+	var explained MetricRoute
+	if trace != nil {
+		onRoute = nil
+		explained = trace.metricRoute(metric)
+	}
+	// results of the last matched rule, backends of a rule are routed one after another
+	var processedRule *RoutingRule
+	var ruleMetrics []*StatsDMetric
+	var aggregated bool
+	for _, target := range router.routingMap.route(metric, router.masterBackend, trace == nil) {
+		rule, routingRule, backend := target.rule, target.routingRule, target.backend
+		send, reason := backendDecision(backend)
+		if tapping {
+			routes = append(routes, TapRoute{Rule: rule, Backend: backend.Key(), Master: backend == router.masterBackend, Send: send, Reason: reason})
+		}
+		if onRoute != nil {
+			onRoute(rule, backend, send, reason)
+		}
+		if routingRule == nil {
+			if trace != nil {
+				master := newBackendRoute(backend, send, reason)
+				master.Aggregated = aggregations.master != nil
+				explained.Master = &master
+				continue
+			}
+			if aggregations.master != nil && router.aggregate("", metric) {
+				continue
+			}
+			router.sendMetric(backend, metric, send)
+			continue
+		}
+		var ruleRoute *RuleRoute
+		if trace != nil {
+			if len(explained.Rules) == 0 || explained.Rules[len(explained.Rules)-1].Rule != rule {
+				explained.Rules = append(explained.Rules, RuleRoute{Rule: rule})
+			}
+			ruleRoute = &explained.Rules[len(explained.Rules)-1]
+		}
+		limiter := limits.rules[rule]
+		aggregator := aggregations.rules[rule]
+		if limiter == nil && len(target.processors) == 0 && aggregator == nil {
+			if trace != nil {
+				ruleRoute.Backends = append(ruleRoute.Backends, newBackendRoute(backend, send, reason))
+				continue
+			}
+			router.sendMetric(backend, metric, send)
+			continue
+		}
+		if processedRule != routingRule {
+			processedRule = routingRule
+			ruleMetrics = ruleMetrics[:0]
+			// the limiter and processors change a copy, other rules get the original metric
+			candidate := metric
+			if limiter != nil || len(target.processors) > 0 {
+				candidate = metric.Clone()
+			}
+			allowed := true
+			if limiter != nil {
+				if trace == nil {
+					allowed = limiter.Allow(candidate)
+				} else {
+					var note string
+					if allowed, note = limiter.explain(candidate); !allowed {
+						ruleRoute.Dropped = note
+					} else if note != "" {
+						ruleRoute.Notes = append(ruleRoute.Notes, note)
 					}
 				}
 			}
-			if masterBackend.Status.Alive {
-				masterBackend.SendChannel <- metric.raw
+			if allowed {
+				emitted := runProcessors(target.processors, candidate, func(processed *StatsDMetric) {
+					ruleMetrics = append(ruleMetrics, processed)
+				})
+				if emitted == 0 && trace != nil {
+					ruleRoute.Dropped = "dropped by processors of the rule"
+				} else if emitted == 0 {
+					router.stats.ProcessorDrops.Add(1)
+				}
 			}
-		case <-quit:
-			log.Println("Terminating metricHandler goroutine")
-			return
+			if trace != nil && candidate != metric {
+				for _, processed := range ruleMetrics {
+					ruleRoute.Metrics = append(ruleRoute.Metrics, string(processed.Raw()))
+				}
+			}
+			// aggregated metrics are sent to all backends of the rule at flush time
+			aggregated = aggregator != nil && (trace != nil || router.aggregate(rule, ruleMetrics...))
+		}
+		if trace != nil {
+			backendRoute := newBackendRoute(backend, send, reason)
+			backendRoute.Aggregated = aggregated
+			ruleRoute.Backends = append(ruleRoute.Backends, backendRoute)
+			continue
+		}
+		if aggregated {
+			continue
+		}
+		for _, processed := range ruleMetrics {
+			router.sendMetric(backend, processed, send)
+		}
+	}
+	if trace != nil {
+		trace.routes = append(trace.routes, explained)
+		return
+	}
+	if tapping {
+		router.taps.Publish(metric, routes)
+	}
+}
+
+// Adds metrics to the current aggregator of the rule, empty rule means the master backend
+// the aggregator is looked up and used under the read lock, so UpdateRules flushes
+// replaced aggregators only after metrics in flight were added to them
+// returns false if the aggregator was removed meanwhile
+func (router *Router) aggregate(rule string, metrics ...*StatsDMetric) bool {
+	router.aggregationsLock.RLock()
+	defer router.aggregationsLock.RUnlock()
+	current := router.aggregations.Load()
+	aggregator := current.master
+	if rule != "" {
+		aggregator = current.rules[rule]
+	}
+	if aggregator == nil {
+		return false
+	}
+	for _, metric := range metrics {
+		aggregator.Add(metric)
+	}
+	return true
+}
+
+// Enqueues the metric to the backend or, if it must not be sent, spools or drops it
+func (router *Router) sendMetric(backend *StatsDBackend, metric *StatsDMetric, send bool) {
+	if !send {
+		if !backend.SpoolMetric(metric.Raw()) {
+			backend.Stats.Dropped.Add(1)
 		}
+		return
 	}
+	backend.Enqueue(metric.Raw())
 }
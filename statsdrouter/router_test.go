@@ -0,0 +1,344 @@
+package statsdrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Creates a router with the config whose backends are UDP sockets without health checks
+// nothing is listening, metrics are routed with InjectMetrics
+func newTestRouter(t *testing.T, config *RouterConfig) *Router {
+	t.Helper()
+	logging, err := NewLogging(io.Discard, LogFormatLogfmt, slog.LevelError)
+	if err != nil {
+		t.Fatalf("NewLogging failed: %v", err)
+	}
+	noHealthCheck := &HealthCheckConfig{Type: HealthCheckNone}
+	for _, nodes := range config.Rules {
+		for i := range nodes {
+			nodes[i].HealthCheck = noHealthCheck
+		}
+	}
+	router, err := NewRouter(RouterOptions{
+		MasterHost: StatsdNode{Host: "127.0.0.1", Port: 18200, ManagementPort: 18201, HealthCheck: noHealthCheck},
+		Config:     config,
+		Backend: BackendOptions{
+			CheckInterval:          3600,
+			UnhealthyCheckInterval: 3600,
+			Rise:                   DefaultHealthCheckRise,
+			Fall:                   DefaultHealthCheckFall,
+			OverflowPolicy:         OverflowPolicyDropNewest,
+		},
+		Logging: logging,
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	t.Cleanup(func() { router.Close() })
+	return router
+}
+
+// Routes the packet in dry-run mode
+func explainPacket(router *Router, packet string) []MetricRoute {
+	trace := &routeTrace{routes: []MetricRoute{}}
+	for _, metric := range parsePacket([]byte(packet)) {
+		router.routeMetric(metric, trace)
+	}
+	return trace.routes
+}
+
+func TestRouteDryRunAppliesRoutingSteps(t *testing.T) {
+	router := newTestRouter(t, &RouterConfig{
+		Rules: map[string][]StatsdNode{
+			`^app\.`:      {{Host: "127.0.0.1", Port: 18210, ManagementPort: 18211}},
+			`^app\.api\.`: {{Host: "127.0.0.1", Port: 18220, ManagementPort: 18221}},
+		},
+		RuleProcessors: map[string][]ProcessorConfig{
+			`^app\.api\.`: {{Type: "add_tags", Options: json.RawMessage(`{"tags": ["env:test"]}`)}},
+		},
+		RateLimits: []RateLimitConfig{
+			{Prefix: "app.limited.", Rate: 0.001, Burst: 1},
+			{Rule: `^app\.api\.`, Rate: 0.001, Burst: 1},
+		},
+		CardinalityLimits: []CardinalityLimitConfig{
+			{Prefix: "app.card.", MaxNames: 1, Action: CardinalityActionOverflow},
+			{Prefix: "app.quarantined.", MaxNames: 1, Action: CardinalityActionQuarantine, Backend: "127.0.0.1:18210:18211"},
+		},
+		Aggregation: &AggregationsConfig{Rules: map[string]AggregationConfig{`^app\.`: {FlushInterval: 3600}}},
+	})
+	// takes the tokens of the rate limits and the only names of the cardinality limits
+	if err := router.InjectMetrics([]byte("app.limited.a:1|c\napp.api.a:1|c\napp.card.a:1|c\napp.quarantined.a:1|c")); err != nil {
+		t.Fatalf("InjectMetrics failed: %v", err)
+	}
+	received := router.RuleAggregators()[`^app\.`].Stats.Received.Load()
+
+	routes := explainPacket(router, "app.limited.a:1|c\napp.api.b:1|c\napp.card.b:1|c\napp.quarantined.b:1|c")
+	if len(routes) != 4 {
+		t.Fatalf("got %d routes, want 4: %+v", len(routes), routes)
+	}
+
+	if routes[0].Dropped != "over rate limit prefix:app.limited." || len(routes[0].Rules) != 0 || routes[0].Master != nil {
+		t.Errorf("prefix rate limit: got %+v", routes[0])
+	}
+
+	api := routes[1]
+	if len(api.Rules) != 2 || api.Rules[0].Rule != `^app\.` || api.Rules[1].Rule != `^app\.api\.` {
+		t.Fatalf("rules of app.api.b: got %+v", api.Rules)
+	}
+	if !api.Rules[0].Backends[0].Aggregated {
+		t.Errorf("backend of aggregated rule is not marked as aggregated: %+v", api.Rules[0])
+	}
+	if api.Rules[1].Dropped != "over rate limit rule:^app\\.api\\." {
+		t.Errorf("rule rate limit: got %+v", api.Rules[1])
+	}
+	if api.Master == nil || api.Master.Aggregated {
+		t.Errorf("master: got %+v", api.Master)
+	}
+
+	renamed := routes[2]
+	if renamed.Name != "app.card.overflow" || renamed.Metric != "app.card.overflow:1|c" {
+		t.Errorf("overflow: got name %q and metric %q", renamed.Name, renamed.Metric)
+	}
+	if want := []string{`renamed from app.card.b, over cardinality limit of group "app.card."`}; !reflect.DeepEqual(renamed.Notes, want) {
+		t.Errorf("overflow notes: got %q, want %q", renamed.Notes, want)
+	}
+	if len(renamed.Rules) != 1 || renamed.Master == nil {
+		t.Errorf("renamed metric is not routed: %+v", renamed)
+	}
+
+	quarantined := routes[3]
+	if quarantined.Quarantine == nil || quarantined.Quarantine.Backend != "127.0.0.1:18210:18211" {
+		t.Errorf("quarantine: got %+v", quarantined.Quarantine)
+	}
+	if len(quarantined.Rules) != 0 || quarantined.Master != nil {
+		t.Errorf("quarantined metric is routed to rules or master: %+v", quarantined)
+	}
+
+	// nothing is counted or added by the dry run
+	if got := router.RuleAggregators()[`^app\.`].Stats.Received.Load(); got != received {
+		t.Errorf("dry run added %d metrics to the aggregator", got-received)
+	}
+	for _, limiter := range router.CardinalityLimiters() {
+		if got := limiter.Stats.Rejected.Load(); got != 0 {
+			t.Errorf("dry run counted %d rejected names of %q", got, limiter.Config.Prefix)
+		}
+	}
+	for _, limiter := range router.RateLimiters() {
+		if got := limiter.Stats.Dropped.Load(); got != 0 {
+			t.Errorf("dry run counted %d dropped metrics of %s", got, limiter.Config.Key())
+		}
+	}
+}
+
+func TestRouteDryRunShowsRuleProcessorOutput(t *testing.T) {
+	router := newTestRouter(t, &RouterConfig{
+		Rules: map[string][]StatsdNode{
+			`^app\.`: {{Host: "127.0.0.1", Port: 18210, ManagementPort: 18211}},
+		},
+		Processors: []ProcessorConfig{{Type: "filter", Options: json.RawMessage(`{"name": "^app\\.debug\\.", "drop": true}`)}},
+		RuleProcessors: map[string][]ProcessorConfig{
+			`^app\.`: {{Type: "add_tags", Options: json.RawMessage(`{"tags": ["env:test"]}`)}},
+		},
+	})
+	routes := explainPacket(router, "app.hits:1|c\napp.debug.hits:1|c")
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2: %+v", len(routes), routes)
+	}
+	if want := []string{"app.hits:1|c|#env:test"}; len(routes[0].Rules) != 1 || !reflect.DeepEqual(routes[0].Rules[0].Metrics, want) {
+		t.Errorf("rule metrics: got %+v, want %q", routes[0].Rules, want)
+	}
+	if routes[0].Metric != "app.hits:1|c" {
+		t.Errorf("rule processors changed the original metric: %q", routes[0].Metric)
+	}
+	if routes[1].Dropped != "dropped by processors" {
+		t.Errorf("filtered metric: got %+v", routes[1])
+	}
+}
+
+func TestUpdateRulesDoesNotLoseAggregatedMetrics(t *testing.T) {
+	aggregation := func() *AggregationsConfig {
+		return &AggregationsConfig{Master: &AggregationConfig{FlushInterval: 3600}}
+	}
+	router := newTestRouter(t, &RouterConfig{Aggregation: aggregation()})
+	// widens the window between routing a metric and adding it to the aggregator
+	router.options.Hooks.OnRoute = func(rule string, backend *StatsDBackend, send bool, reason string) {
+		runtime.Gosched()
+	}
+
+	// metrics are injected until aggregators were replaced a hundred times
+	done := make(chan struct{})
+	var injected atomic.Uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				router.InjectMetrics([]byte("hits:1|c"))
+				injected.Add(1)
+			}
+		}()
+	}
+	var aggregators []*Aggregator
+	for i := 0; i < 100; i++ {
+		aggregators = append(aggregators, router.MasterAggregator())
+		if err := router.UpdateRules(&RouterConfig{Rules: map[string][]StatsdNode{}, Aggregation: aggregation()}); err != nil {
+			t.Fatalf("UpdateRules failed: %v", err)
+		}
+		runtime.Gosched()
+	}
+	close(done)
+	wg.Wait()
+
+	// replaced aggregators were flushed, so a metric left in one of them is never sent
+	var received uint64
+	for i, aggregator := range aggregators {
+		aggregator.lock.Lock()
+		left := len(aggregator.aggregates)
+		aggregator.lock.Unlock()
+		if left > 0 {
+			t.Fatalf("replaced aggregator %d has metrics added after its flush", i)
+		}
+		received += aggregator.Stats.Received.Load()
+	}
+	received += router.MasterAggregator().Stats.Received.Load()
+	if received != injected.Load() {
+		t.Fatalf("aggregators received %d metrics, %d were injected", received, injected.Load())
+	}
+}
+
+func TestParsePacketAndFormatRoundTrip(t *testing.T) {
+	lines := []string{
+		"app.hits:1|c",
+		"app.hits:2|c|@0.5",
+		"app.latency:12.5|ms|@0.1|#env:prod,canary",
+		"app.temp:-3|g",
+		"app.temp:+3|g",
+		"app.users:alice|s",
+		"app.hits:1|c|#env:prod|c:abc123",
+		"app.hits:1|c|T1700000000",
+	}
+	metrics := parsePacket([]byte(strings.Join(lines, "\n") + "\n"))
+	if len(metrics) != len(lines) {
+		t.Fatalf("parsed %d metrics from %d lines", len(metrics), len(lines))
+	}
+	for i, metric := range metrics {
+		if metric.err != nil {
+			t.Fatalf("%q: %v", lines[i], metric.err)
+		}
+		if got := string(metric.format()); got != lines[i] {
+			t.Errorf("format of %q = %q", lines[i], got)
+		}
+	}
+
+	// a changed metric is formatted again instead of the received line
+	metric := metrics[2]
+	metric.AddTags("dc:eu")
+	if got, want := string(metric.Raw()), "app.latency:12.5|ms|@0.1|#env:prod,canary,dc:eu"; got != want {
+		t.Errorf("Raw of changed metric = %q, want %q", got, want)
+	}
+	if got := metric.SampleRate(); got != 0.1 {
+		t.Errorf("sample rate %v, want 0.1", got)
+	}
+}
+
+func TestParsePacketKeepsMalformedLines(t *testing.T) {
+	metrics := parsePacket([]byte("app.hits:1|c\nbroken\napp.hits|c\napp.hits:1|x\n\n"))
+	if len(metrics) != 4 {
+		t.Fatalf("got %d metrics, want 4", len(metrics))
+	}
+	if metrics[0].err != nil {
+		t.Errorf("valid line has error %v", metrics[0].err)
+	}
+	for _, metric := range metrics[1:] {
+		if metric.err == nil {
+			t.Errorf("malformed line %q has no error", metric.raw)
+		}
+	}
+}
+
+func TestUpdateRulesChangesNothingWhenConfigIsNotSaved(t *testing.T) {
+	config := &RouterConfig{
+		Rules:    map[string][]StatsdNode{`^app\.`: {{Host: "127.0.0.1", Port: 18210, ManagementPort: 18211}}},
+		FilePath: filepath.Join(t.TempDir(), "missing", "config.json"),
+	}
+	router := newTestRouter(t, config)
+	update := &RouterConfig{
+		Rules:       map[string][]StatsdNode{`^db\.`: {{Host: "127.0.0.1", Port: 18220, ManagementPort: 18221, HealthCheck: &HealthCheckConfig{Type: HealthCheckNone}}}},
+		RateLimits:  []RateLimitConfig{{Prefix: "db.", Rate: 1}},
+		Aggregation: &AggregationsConfig{Rules: map[string]AggregationConfig{`^db\.`: {}}},
+	}
+	if err := router.UpdateRules(update); err == nil {
+		t.Fatal("UpdateRules succeeded with unwritable config file")
+	}
+	if backends := router.RoutingMap().RuleBackends(`^db\.`); len(backends) != 0 {
+		t.Errorf("rule was added to routing map: %v", backends)
+	}
+	if backend := router.Backend("127.0.0.1:18220:18221"); backend != nil {
+		t.Errorf("backend of the update was added to routing map")
+	}
+	if got := config.RulesCount(); got != 1 {
+		t.Errorf("config has %d rules, want 1", got)
+	}
+	if config.RateLimits != nil || config.Aggregation != nil {
+		t.Errorf("config keeps limits %v and aggregation %v which were not saved", config.RateLimits, config.Aggregation)
+	}
+	if len(router.RateLimiters()) != 0 || len(router.RuleAggregators()) != 0 {
+		t.Errorf("limits or aggregation of the update were applied")
+	}
+	if got := router.Stats().ConfigReloadsFailed.Load(); got != 1 {
+		t.Errorf("ConfigReloadsFailed = %d, want 1", got)
+	}
+}
+
+func TestConcurrentUpdateRulesKeepRoutingAndConfigInSync(t *testing.T) {
+	config := &RouterConfig{FilePath: filepath.Join(t.TempDir(), "config.json")}
+	router := newTestRouter(t, config)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rule := fmt.Sprintf(`^app%d\.`, i)
+			update := &RouterConfig{
+				Rules:       map[string][]StatsdNode{rule: {{Host: "127.0.0.1", Port: uint16(18300 + 2*i), ManagementPort: uint16(18301 + 2*i), HealthCheck: &HealthCheckConfig{Type: HealthCheckNone}}}},
+				Aggregation: &AggregationsConfig{Rules: map[string]AggregationConfig{rule: {}}},
+			}
+			if err := router.UpdateRules(update); err != nil {
+				t.Errorf("UpdateRules failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(router.RoutingMap().Backends()); got != 8 {
+		t.Fatalf("routing map has %d backends, want 8", got)
+	}
+	if got := config.RulesCount(); got != 8 {
+		t.Fatalf("config has %d rules, want 8", got)
+	}
+	// aggregation of the last saved update is the live one
+	live := router.RuleAggregators()
+	if len(live) != 1 || len(config.Aggregation.Rules) != 1 {
+		t.Fatalf("live aggregations %d, saved %d, want 1 of each", len(live), len(config.Aggregation.Rules))
+	}
+	for rule := range config.Aggregation.Rules {
+		if live[rule] == nil {
+			t.Fatalf("saved aggregation of %q is not the live one", rule)
+		}
+	}
+}
@@ -3,83 +3,431 @@ package statsdrouter
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // Routing Map struct
 type RoutingMap struct {
 	Map map[string]*RoutingRule
 	//internal fields:
-	backendList   map[string]*StatsDBackend
-	checkInterval int64
+	backendList map[string]*StatsDBackend
+	ruleOrder   []string
+	options     BackendOptions
+	resolver    Resolver
+	discoveries map[string]*discovery
+	discoveryWG sync.WaitGroup
+	logging     *Logging
+	logger      *slog.Logger
+	lock        sync.RWMutex
 }
 
 // Routing Rule struct
 type RoutingRule struct {
 	Regexp   *regexp.Regexp
 	Backends []*StatsDBackend
+	Matches  atomic.Uint64
+	// chain applied to copies of metrics sent to backends of the rule
+	processors []Processor
 }
 
 // Creates a new RoutingMap struct
-// accepts a checkInterval as parameter
+// accepts BackendOptions of new backends and *Logging as parameters
 // returns the *RoutingMap struct
-func NewRoutingMap(checkInterval int64) *RoutingMap {
-	result := RoutingMap{make(map[string]*RoutingRule), make(map[string]*StatsDBackend), checkInterval}
+func NewRoutingMap(options BackendOptions, logging *Logging) *RoutingMap {
+	resolver := options.Resolver
+	if resolver == nil {
+		resolver = NewResolver(options.DNSServer)
+	}
+	result := RoutingMap{
+		Map:         make(map[string]*RoutingRule),
+		backendList: make(map[string]*StatsDBackend),
+		options:     options,
+		resolver:    resolver,
+		discoveries: make(map[string]*discovery),
+		logging:     logging,
+		logger:      logging.Logger(ComponentRouting),
+	}
 	return &result
 }
 
+// Changes of the routing map which were checked and prepared, but not applied yet
+type routingMapUpdate struct {
+	config         *RouterConfig
+	ruleProcessors map[string][]Processor
+	regexps        map[string]*regexp.Regexp
+	// backends of listed nodes which were not in the routing map
+	created map[string]*StatsDBackend
+}
+
 // Updates RoutingMap
 // accepts a *RouterConfig (recieved config) as parameter
 // returns an error
 func (routingMap *RoutingMap) UpdateRoutingMap(config *RouterConfig) error {
-	var err error
-	var needAdd bool
-	for rule, nodes := range config.Rules {
-		if _, ok := routingMap.Map[rule]; !ok {
-			ruleRegexp, err := regexp.Compile(rule)
-			if err != nil {
-				log.Printf("Failed to Update RoutingMap with rule %s: %s", rule, err)
-				return err
+	update, err := routingMap.prepareUpdate(config)
+	if err != nil {
+		return err
+	}
+	routingMap.applyUpdate(update)
+	return nil
+}
+
+// Checks the config and creates processors, rule regexps and backends of the update
+// the routing map is not changed, an update which is not applied is dropped with discardUpdate
+// accepts a *RouterConfig (recieved config) as parameter
+// returns the update and an error
+func (routingMap *RoutingMap) prepareUpdate(config *RouterConfig) (*routingMapUpdate, error) {
+	update := &routingMapUpdate{
+		config:         config,
+		ruleProcessors: make(map[string][]Processor, len(config.RuleProcessors)),
+		regexps:        make(map[string]*regexp.Regexp, len(config.Rules)),
+	}
+	for rule, configs := range config.RuleProcessors {
+		processors, err := NewProcessors(configs)
+		if err != nil {
+			routingMap.logger.Error("Failed to update routing map", "rule", rule, "error", err)
+			return nil, fmt.Errorf("processors of rule %q: %w", rule, err)
+		}
+		update.ruleProcessors[rule] = processors
+	}
+	routingMap.lock.RLock()
+	for rule := range update.ruleProcessors {
+		if _, ok := config.Rules[rule]; !ok && routingMap.Map[rule] == nil {
+			routingMap.lock.RUnlock()
+			routingMap.logger.Error("Failed to update routing map", "rule", rule, "error", "processors of unknown rule")
+			return nil, fmt.Errorf("processors of unknown rule %q", rule)
+		}
+	}
+	routingMap.lock.RUnlock()
+	// backends are created before taking the lock, creating a backend dials it and runs
+	// a health check which must not stop routing
+	var nodes []StatsdNode
+	for rule, ruleNodes := range config.Rules {
+		ruleRegexp, err := regexp.Compile(rule)
+		if err != nil {
+			routingMap.logger.Error("Failed to update routing map", "rule", rule, "error", err)
+			return nil, err
+		}
+		update.regexps[rule] = ruleRegexp
+		for _, node := range ruleNodes {
+			if node.Discovery == nil {
+				nodes = append(nodes, node)
+				continue
 			}
-			routingMap.Map[rule] = &RoutingRule{Regexp: ruleRegexp}
+			if err := node.Discovery.validate(); err != nil {
+				routingMap.logger.Error("Failed to update routing map", "rule", rule, "discovery", node.Key(), "error", err)
+				return nil, err
+			}
+		}
+	}
+	created, err := routingMap.createBackends(nodes)
+	if err != nil {
+		return nil, err
+	}
+	update.created = created
+	return update, nil
+}
+
+// Shuts down backends created for an update which is not applied
+func (routingMap *RoutingMap) discardUpdate(update *routingMapUpdate) {
+	routingMap.exitCreatedBackends(update.created)
+}
+
+// Adds rules, backends, discoveries and processors of a prepared update
+// a listed node whose backend a discovery removed from the map after the update was prepared is skipped
+func (routingMap *RoutingMap) applyUpdate(update *routingMapUpdate) {
+	routingMap.lock.Lock()
+	defer func() {
+		routingMap.lock.Unlock()
+		// backends created by a concurrent update
+		routingMap.exitCreatedBackends(update.created)
+	}()
+	for rule, nodes := range update.config.Rules {
+		if _, ok := routingMap.Map[rule]; !ok {
+			routingMap.Map[rule] = &RoutingRule{Regexp: update.regexps[rule]}
+			routingMap.ruleOrder = append(routingMap.ruleOrder, rule)
+			sort.Strings(routingMap.ruleOrder)
 		}
 		for _, node := range nodes {
-			needAdd = false
-			backendKey := fmt.Sprintf("%s:%d:%d", node.Host, node.Port, node.ManagementPort)
-			if _, ok := routingMap.backendList[backendKey]; !ok {
-				if DebugMode {
-					log.Printf("Creating new backend %s", backendKey)
-				}
-				routingMap.backendList[backendKey], err = NewStatsDBackend(node.Host, node.Port, node.ManagementPort, routingMap.checkInterval)
-				if err != nil {
-					log.Printf("Failed to Update RoutingMap with backend %s: %s", backendKey, err)
-					return err
-				}
-				needAdd = true
-			} else {
-				if DebugMode {
-					log.Printf("Using existing backend %s", backendKey)
-				}
-				backend := routingMap.backendList[backendKey]
-				if inSlice := backendInSlice(backend, routingMap.Map[rule].Backends); !inSlice {
-					needAdd = true
+			if node.Discovery != nil {
+				if _, ok := routingMap.discoveries[rule+" "+node.Key()]; !ok {
+					if err := routingMap.startDiscovery(rule, node); err != nil {
+						routingMap.logger.Error("Failed to start discovery", "rule", rule, "discovery", node.Key(), "error", err)
+					}
 				}
+				continue
 			}
-			if needAdd {
-				backend := routingMap.backendList[backendKey]
-				if DebugMode {
-					log.Printf("Adding backend %s to rule %s", backendKey, rule)
-				}
-				routingMap.Map[rule].Backends = append(routingMap.Map[rule].Backends, backend)
-			} else {
-				if DebugMode {
-					log.Printf("Backend %s already exist in rule %s", backendKey, rule)
+			if err := routingMap.addBackendToRule(rule, node, update.created); err != nil {
+				routingMap.logger.Error("Failed to add backend to rule", "rule", rule, "backend", node.Key(), "error", err)
+				continue
+			}
+			// a listed node stays in the rule when discoveries of the rule don't find it anymore
+			for _, d := range routingMap.discoveries {
+				if d.rule == rule {
+					delete(d.backends, node.Key())
 				}
 			}
 		}
 	}
-	return err
+	for rule, processors := range update.ruleProcessors {
+		if routingRule := routingMap.Map[rule]; routingRule != nil {
+			routingRule.processors = processors
+		}
+	}
+}
+
+// Creates backends of the nodes which are not in the routing map yet
+// must be called without the lock held
+// returns the backends by their keys and an error, already created backends are shut down on error
+func (routingMap *RoutingMap) createBackends(nodes []StatsdNode) (map[string]*StatsDBackend, error) {
+	created := make(map[string]*StatsDBackend)
+	for _, node := range nodes {
+		backendKey := node.Key()
+		if created[backendKey] != nil || routingMap.Backend(backendKey) != nil {
+			continue
+		}
+		routingMap.logger.Debug("Creating new backend", "backend", backendKey)
+		backend, err := NewStatsDBackend(node, routingMap.options, routingMap.logging.Logger(ComponentBackend))
+		if err != nil {
+			routingMap.logger.Error("Failed to update routing map", "backend", backendKey, "error", err)
+			routingMap.exitCreatedBackends(created)
+			return nil, err
+		}
+		created[backendKey] = backend
+	}
+	return created, nil
+}
+
+// Shuts down created backends which were not added to the routing map
+func (routingMap *RoutingMap) exitCreatedBackends(created map[string]*StatsDBackend) {
+	if len(created) == 0 {
+		return
+	}
+	backends := make([]*StatsDBackend, 0, len(created))
+	for _, backend := range created {
+		backends = append(backends, backend)
+	}
+	routingMap.exitBackends(backends)
+}
+
+// Replaces processor chain of the rule
+// accepts a rule and processors in chain order, no processors remove the chain
+// returns an error if there is no such rule
+func (routingMap *RoutingMap) SetRuleProcessors(rule string, processors ...Processor) error {
+	routingMap.lock.Lock()
+	defer routingMap.lock.Unlock()
+	routingRule := routingMap.Map[rule]
+	if routingRule == nil {
+		return fmt.Errorf("rule %q not found", rule)
+	}
+	routingRule.processors = processors
+	return nil
+}
+
+// Adds backend of the node to the rule
+// a backend which is not in the routing map yet is taken out of created backends
+// must be called with the lock held
+// returns an error
+func (routingMap *RoutingMap) addBackendToRule(rule string, node StatsdNode, created map[string]*StatsDBackend) error {
+	backendKey := node.Key()
+	backend := routingMap.backendList[backendKey]
+	if backend == nil {
+		backend = created[backendKey]
+		if backend == nil {
+			return fmt.Errorf("backend %q was not created", backendKey)
+		}
+		delete(created, backendKey)
+		routingMap.backendList[backendKey] = backend
+	} else {
+		routingMap.logger.Debug("Using existing backend", "backend", backendKey)
+	}
+	if backendInSlice(backend, routingMap.Map[rule].Backends) {
+		routingMap.logger.Debug("Backend already exists in rule", "backend", backendKey, "rule", rule)
+		return nil
+	}
+	routingMap.logger.Debug("Adding backend to rule", "backend", backendKey, "rule", rule)
+	routingMap.Map[rule].Backends = append(routingMap.Map[rule].Backends, backend)
+	return nil
+}
+
+// Removes the rule, stops its discoveries and shuts down backends not used by other rules
+// accepts a rule as parameter
+// returns an error if there is no such rule
+func (routingMap *RoutingMap) RemoveRule(rule string) error {
+	var removed []*StatsDBackend
+	routingMap.lock.Lock()
+	defer func() {
+		routingMap.lock.Unlock()
+		routingMap.exitBackends(removed)
+	}()
+	routingRule := routingMap.Map[rule]
+	if routingRule == nil {
+		return fmt.Errorf("rule %q not found", rule)
+	}
+	for key, d := range routingMap.discoveries {
+		if d.rule == rule {
+			removed = append(removed, routingMap.stopDiscovery(key)...)
+		}
+	}
+	for _, backend := range append([]*StatsDBackend(nil), routingRule.Backends...) {
+		if removedBackend := routingMap.removeBackendFromRule(rule, backend.Key()); removedBackend != nil {
+			removed = append(removed, removedBackend)
+		}
+	}
+	delete(routingMap.Map, rule)
+	ruleOrder := routingMap.ruleOrder[:0:0]
+	for _, v := range routingMap.ruleOrder {
+		if v != rule {
+			ruleOrder = append(ruleOrder, v)
+		}
+	}
+	routingMap.ruleOrder = ruleOrder
+	return nil
+}
+
+// Removes the node from the rule, discovery nodes are stopped with all backends they have added
+// backends not used by other rules are shut down
+// accepts a rule and a node key (host:port:mgmt_port or type:name) as parameters
+// returns an error if the rule doesn't have such node
+func (routingMap *RoutingMap) RemoveNode(rule string, nodeKey string) error {
+	var removed []*StatsDBackend
+	routingMap.lock.Lock()
+	defer func() {
+		routingMap.lock.Unlock()
+		routingMap.exitBackends(removed)
+	}()
+	if routingMap.Map[rule] == nil {
+		return fmt.Errorf("rule %q not found", rule)
+	}
+	if _, ok := routingMap.discoveries[rule+" "+nodeKey]; ok {
+		removed = routingMap.stopDiscovery(rule + " " + nodeKey)
+		return nil
+	}
+	backend := routingMap.backendList[nodeKey]
+	if backend == nil || !backendInSlice(backend, routingMap.Map[rule].Backends) {
+		return fmt.Errorf("backend %q not found in rule %q", nodeKey, rule)
+	}
+	if removedBackend := routingMap.removeBackendFromRule(rule, nodeKey); removedBackend != nil {
+		removed = append(removed, removedBackend)
+	}
+	return nil
+}
+
+// Called for every backend a routing decision was made for
+// rule is empty for the master backend
+type RouteFunc func(rule string, backend *StatsDBackend, send bool, reason string)
+
+// Backend a metric is routed to
+type routeTarget struct {
+	// matched rule, empty for the master backend
+	rule string
+	// nil for the master backend
+	routingRule *RoutingRule
+	// chain of the rule at the time of routing
+	processors []Processor
+	backend    *StatsDBackend
+}
+
+// Collects backends of rules matching the metric in rule order and finally the master backend
+// the lock is held only while collecting, so sending to the targets doesn't block updates
+func (routingMap *RoutingMap) route(metric *StatsDMetric, masterBackend *StatsDBackend, countMatches bool) []routeTarget {
+	var targets []routeTarget
+	routingMap.lock.RLock()
+	for _, rule := range routingMap.ruleOrder {
+		routingRule := routingMap.Map[rule]
+		if !routingRule.Regexp.MatchString(metric.name) {
+			continue
+		}
+		if countMatches {
+			routingRule.Matches.Add(1)
+		}
+		for _, backend := range routingRule.Backends {
+			targets = append(targets, routeTarget{rule: rule, routingRule: routingRule, processors: routingRule.processors, backend: backend})
+		}
+	}
+	routingMap.lock.RUnlock()
+	return append(targets, routeTarget{backend: masterBackend})
+}
+
+// Decides if a backend should receive a metric
+// returns the decision and its reason
+func backendDecision(backend *StatsDBackend) (bool, string) {
+	switch backend.Mode() {
+	case BackendModeMaintenance:
+		if backend.spool != nil {
+			return false, "backend is in maintenance, metric is spooled"
+		}
+		return false, "backend is in maintenance"
+	case BackendModeDrain:
+		return false, "backend is draining"
+	}
+	if !backend.Status().Alive {
+		if backend.spool != nil {
+			return false, "backend is down, metric is spooled"
+		}
+		return false, "backend is down"
+	}
+	return true, "backend is alive"
+}
+
+// Returns all backends of the routing map sorted by their keys
+func (routingMap *RoutingMap) Backends() []*StatsDBackend {
+	routingMap.lock.RLock()
+	defer routingMap.lock.RUnlock()
+	keys := make([]string, 0, len(routingMap.backendList))
+	for key := range routingMap.backendList {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	backends := make([]*StatsDBackend, 0, len(keys))
+	for _, key := range keys {
+		backends = append(backends, routingMap.backendList[key])
+	}
+	return backends
+}
+
+// Returns all rules of the routing map in the order they are checked
+func (routingMap *RoutingMap) Rules() []*RoutingRule {
+	routingMap.lock.RLock()
+	defer routingMap.lock.RUnlock()
+	rules := make([]*RoutingRule, 0, len(routingMap.ruleOrder))
+	for _, rule := range routingMap.ruleOrder {
+		rules = append(rules, routingMap.Map[rule])
+	}
+	return rules
+}
+
+// Returns backends of the rule or nil if there is no such rule
+func (routingMap *RoutingMap) RuleBackends(rule string) []*StatsDBackend {
+	routingMap.lock.RLock()
+	defer routingMap.lock.RUnlock()
+	if routingRule := routingMap.Map[rule]; routingRule != nil {
+		return append([]*StatsDBackend(nil), routingRule.Backends...)
+	}
+	return nil
+}
+
+// Returns backend by its key or nil if there is no such backend
+func (routingMap *RoutingMap) Backend(backendKey string) *StatsDBackend {
+	routingMap.lock.RLock()
+	defer routingMap.lock.RUnlock()
+	return routingMap.backendList[backendKey]
+}
+
+// Returns rules which reference the backend
+func (routingMap *RoutingMap) RulesForBackend(backend *StatsDBackend) []string {
+	routingMap.lock.RLock()
+	defer routingMap.lock.RUnlock()
+	rules := []string{}
+	for _, rule := range routingMap.ruleOrder {
+		if backendInSlice(backend, routingMap.Map[rule].Backends) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
 }
 
 // Checks if *StatsDBackend is in []*StatsDBackend
@@ -0,0 +1,404 @@
+// Disk-backed spool of metrics for unreachable backends
+package statsdrouter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default spool settings
+const (
+	DefaultSpoolMaxSize     = 1 << 30
+	DefaultSpoolSegmentSize = 1 << 20
+	DefaultSpoolReplayRate  = 1000
+	spoolSegmentSuffix      = ".spool"
+	// file next to a segment with the number of its bytes which are already replayed
+	spoolOffsetSuffix = ".offset"
+	spoolReplayTick   = 100 * time.Millisecond
+)
+
+// Spool settings of a node
+type SpoolConfig struct {
+	// Directory with segment files, each backend uses its own subdirectory
+	Directory string `json:"directory"`
+	// Max total size of segments in bytes, oldest segments are dropped when it is exceeded
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Max size of a single segment file in bytes
+	SegmentSize int64 `json:"segment_size,omitempty"`
+	// Max age of a segment in seconds, 0 means no limit
+	MaxAge int64 `json:"max_age,omitempty"`
+	// Max number of replayed metrics per second
+	ReplayRate int `json:"replay_rate,omitempty"`
+}
+
+// Spool struct
+// metrics are appended to the newest segment and replayed from the oldest one
+type Spool struct {
+	config    SpoolConfig
+	directory string
+	logger    *slog.Logger
+	lock      sync.Mutex
+	// closed segments, oldest first
+	segments []spoolSegment
+	// segment which is being written
+	current       spoolSegment
+	currentFile   *os.File
+	currentWriter *bufio.Writer
+	nextSequence  uint64
+	// segment which is being replayed, its records which are not replayed yet and
+	// their offset in the file; the offset is persisted, so a restart doesn't replay
+	// records again, and the file is deleted only when all its records are replayed
+	replayingSegment *spoolSegment
+	replaying        []byte
+	replayOffset     int64
+
+	Size     atomic.Int64
+	Spooled  atomic.Uint64
+	Replayed atomic.Uint64
+	Dropped  atomic.Uint64
+}
+
+// Segment file description
+type spoolSegment struct {
+	sequence uint64
+	path     string
+	size     int64
+	created  time.Time
+}
+
+// Opens a spool of the backend, segments left from previous runs are kept for replay
+// accepts a SpoolConfig, a backend key and logger as parameters
+// returns the *Spool struct and an error
+func OpenSpool(config SpoolConfig, backendKey string, logger *slog.Logger) (*Spool, error) {
+	if config.Directory == "" {
+		return nil, errors.New("spool directory is not set")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultSpoolMaxSize
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSpoolSegmentSize
+	}
+	if config.ReplayRate <= 0 {
+		config.ReplayRate = DefaultSpoolReplayRate
+	}
+	spool := &Spool{
+		config:    config,
+		directory: filepath.Join(config.Directory, metricNameSanitizer.Replace(backendKey)),
+		logger:    logger,
+	}
+	if err := os.MkdirAll(spool.directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(spool.directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		spool.segments = append(spool.segments, spoolSegment{sequence: sequence, path: filepath.Join(spool.directory, name), size: info.Size(), created: info.ModTime()})
+		spool.Size.Add(info.Size())
+		if sequence >= spool.nextSequence {
+			spool.nextSequence = sequence + 1
+		}
+	}
+	sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i].sequence < spool.segments[j].sequence })
+	if len(spool.segments) > 0 {
+		logger.Info("Found spooled metrics from previous run", "segments", len(spool.segments), "bytes", spool.Size.Load())
+	}
+	return spool, nil
+}
+
+// Appends a metric to the spool
+// returns an error if the metric can't be written
+func (spool *Spool) Write(metric []byte) error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	if spool.currentFile == nil || spool.current.size >= spool.config.SegmentSize {
+		if err := spool.rotate(); err != nil {
+			return err
+		}
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(metric)))
+	if _, err := spool.currentWriter.Write(header[:]); err != nil {
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	if _, err := spool.currentWriter.Write(metric); err != nil {
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	recordSize := int64(len(header) + len(metric))
+	spool.current.size += recordSize
+	spool.Size.Add(recordSize)
+	spool.Spooled.Add(1)
+	spool.enforceLimits()
+	return nil
+}
+
+// Checks if there are spooled metrics
+func (spool *Spool) Empty() bool {
+	return spool.Size.Load() == 0
+}
+
+// Returns number of metrics to replay per spoolReplayTick
+func (spool *Spool) replayBatch() int {
+	batch := spool.config.ReplayRate * int(spoolReplayTick) / int(time.Second)
+	if batch < 1 {
+		batch = 1
+	}
+	return batch
+}
+
+// Splits the first record off the data
+// returns the record, its size with the header and false if the data doesn't start with a complete record
+func nextSpoolRecord(data []byte) ([]byte, int, bool) {
+	if len(data) < 4 {
+		return nil, 0, false
+	}
+	length := int(binary.BigEndian.Uint32(data))
+	if len(data) < 4+length {
+		return nil, 0, false
+	}
+	return data[4 : 4+length], 4 + length, true
+}
+
+// Returns up to count oldest metrics, they stay in the spool until they are acknowledged with Ack
+// metrics are returned from one segment at a time, the next one is opened when all records
+// of the current one are acknowledged
+func (spool *Spool) Peek(count int) [][]byte {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	if _, _, ok := nextSpoolRecord(spool.replaying); !ok {
+		// the segment is replayed, the rest is a truncated record at its end if anything
+		if spool.replayingSegment != nil {
+			spool.removeSegment(*spool.replayingSegment)
+			spool.replayingSegment = nil
+		}
+		spool.replaying = nil
+		if !spool.loadOldestSegment() {
+			return nil
+		}
+	}
+	var metrics [][]byte
+	for data := spool.replaying; len(metrics) < count; {
+		record, size, ok := nextSpoolRecord(data)
+		if !ok {
+			break
+		}
+		metrics = append(metrics, record)
+		data = data[size:]
+	}
+	return metrics
+}
+
+// Removes count oldest metrics returned by Peek from the spool and persists the replay position
+func (spool *Spool) Ack(count int) {
+	if count <= 0 {
+		return
+	}
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	acked := 0
+	for ; acked < count; acked++ {
+		_, size, ok := nextSpoolRecord(spool.replaying)
+		if !ok {
+			break
+		}
+		spool.replaying = spool.replaying[size:]
+		spool.replayOffset += int64(size)
+	}
+	spool.Replayed.Add(uint64(acked))
+	if spool.replayingSegment == nil {
+		return
+	}
+	if err := writeSpoolOffset(spool.replayingSegment.path, spool.replayOffset); err != nil {
+		spool.logger.Error("Failed to persist spool replay offset", "path", spool.replayingSegment.path, "error", err)
+	}
+}
+
+// Writes the replay offset of a segment, the file is replaced atomically
+func writeSpoolOffset(segmentPath string, offset int64) error {
+	path := segmentPath + spoolOffsetSuffix
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Reads the replay offset of a segment, segments without offset are replayed from the start
+func readSpoolOffset(segmentPath string) int64 {
+	data, err := os.ReadFile(segmentPath + spoolOffsetSuffix)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// Reads the oldest segment into memory, records before its persisted replay offset are skipped
+// the segment which is being written is closed first if there are no other ones
+// returns false if the spool is empty
+func (spool *Spool) loadOldestSegment() bool {
+	if len(spool.segments) == 0 {
+		if spool.current.size == 0 {
+			return false
+		}
+		if err := spool.closeCurrent(); err != nil {
+			spool.logger.Error("Failed to close spool segment", "error", err)
+			return false
+		}
+	}
+	segment := spool.segments[0]
+	spool.segments = spool.segments[1:]
+	data, err := os.ReadFile(segment.path)
+	if err != nil {
+		spool.logger.Error("Failed to read spool segment", "path", segment.path, "error", err)
+	}
+	offset := readSpoolOffset(segment.path)
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		spool.logger.Info("Resuming replay of spool segment", "path", segment.path, "offset", offset)
+	}
+	spool.replayingSegment = &segment
+	spool.replaying = data[offset:]
+	spool.replayOffset = offset
+	return true
+}
+
+// Closes the segment which is being written and starts a new one
+func (spool *Spool) rotate() error {
+	if err := spool.closeCurrent(); err != nil {
+		return err
+	}
+	segment := spoolSegment{
+		sequence: spool.nextSequence,
+		path:     filepath.Join(spool.directory, fmt.Sprintf("%020d%s", spool.nextSequence, spoolSegmentSuffix)),
+		created:  time.Now(),
+	}
+	file, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	spool.nextSequence++
+	spool.current = segment
+	spool.currentFile = file
+	spool.currentWriter = bufio.NewWriter(file)
+	return nil
+}
+
+// Flushes and closes the segment which is being written and adds it to closed segments
+func (spool *Spool) closeCurrent() error {
+	if spool.currentFile == nil {
+		return nil
+	}
+	err := spool.currentWriter.Flush()
+	if closeErr := spool.currentFile.Close(); err == nil {
+		err = closeErr
+	}
+	if spool.current.size > 0 {
+		spool.segments = append(spool.segments, spool.current)
+	} else {
+		os.Remove(spool.current.path)
+	}
+	spool.current = spoolSegment{}
+	spool.currentFile = nil
+	spool.currentWriter = nil
+	return err
+}
+
+// Drops oldest segments which exceed size or age limits
+func (spool *Spool) enforceLimits() {
+	for len(spool.segments) > 0 {
+		oldest := spool.segments[0]
+		tooBig := spool.Size.Load() > spool.config.MaxSize
+		tooOld := spool.config.MaxAge > 0 && time.Since(oldest.created) > time.Duration(spool.config.MaxAge)*time.Second
+		if !tooBig && !tooOld {
+			return
+		}
+		records := spool.countRecords(oldest.path)
+		spool.logger.Warn("Dropping oldest spool segment", "path", oldest.path, "bytes", oldest.size, "metrics", records, "too_big", tooBig, "too_old", tooOld)
+		spool.Dropped.Add(records)
+		spool.segments = spool.segments[1:]
+		spool.removeSegment(oldest)
+	}
+}
+
+// Counts records in a segment file
+func (spool *Spool) countRecords(path string) uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var count uint64
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return count
+		}
+		if _, err := reader.Discard(int(binary.BigEndian.Uint32(header[:]))); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+// Deletes the segment file and its replay offset
+func (spool *Spool) removeSegment(segment spoolSegment) {
+	spool.Size.Add(-segment.size)
+	if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+		spool.logger.Error("Failed to remove spool segment", "path", segment.path, "error", err)
+	}
+	os.Remove(segment.path + spoolOffsetSuffix)
+}
+
+// Flushes buffered metrics to disk and applies age limit
+func (spool *Spool) Flush() {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	if spool.currentWriter != nil {
+		if err := spool.currentWriter.Flush(); err != nil {
+			spool.logger.Error("Failed to flush spool", "error", err)
+		}
+		if spool.config.MaxAge > 0 && time.Since(spool.current.created) > time.Duration(spool.config.MaxAge)*time.Second {
+			spool.closeCurrent()
+		}
+	}
+	spool.enforceLimits()
+}
+
+// Flushes and closes the spool, not replayed metrics stay on disk
+func (spool *Spool) Close() error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return spool.closeCurrent()
+}
@@ -0,0 +1,151 @@
+package statsdrouter
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Writes count metrics named m0, m1, ... to the spool
+func writeSpoolMetrics(t *testing.T, spool *Spool, from, count int) {
+	t.Helper()
+	for i := from; i < from+count; i++ {
+		if err := spool.Write([]byte(fmt.Sprintf("m%d:1|c", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// Peeks and acknowledges metrics until the spool is empty
+func drainSpool(spool *Spool, batch int) []string {
+	var metrics []string
+	for {
+		peeked := spool.Peek(batch)
+		if len(peeked) == 0 {
+			return metrics
+		}
+		for _, metric := range peeked {
+			metrics = append(metrics, string(metric))
+		}
+		spool.Ack(len(peeked))
+	}
+}
+
+func segmentFiles(t *testing.T, directory string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(directory, "*", "*"+spoolSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestSpoolRotatesAndReplaysInOrder(t *testing.T) {
+	directory := t.TempDir()
+	// every record is 4+7 bytes, so a segment holds 2 of them
+	spool, err := OpenSpool(SpoolConfig{Directory: directory, SegmentSize: 20}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolMetrics(t, spool, 0, 6)
+	spool.Flush()
+	if files := segmentFiles(t, directory); len(files) != 3 {
+		t.Fatalf("got %d segments, want 3: %v", len(files), files)
+	}
+	if spool.Spooled.Load() != 6 {
+		t.Fatalf("Spooled = %d, want 6", spool.Spooled.Load())
+	}
+
+	got := drainSpool(spool, 3)
+	want := []string{"m0:1|c", "m1:1|c", "m2:1|c", "m3:1|c", "m4:1|c", "m5:1|c"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	if !spool.Empty() || spool.Replayed.Load() != 6 {
+		t.Fatalf("Empty = %v, Replayed = %d after replay", spool.Empty(), spool.Replayed.Load())
+	}
+	if files := segmentFiles(t, directory); len(files) != 0 {
+		t.Fatalf("replayed segments are not removed: %v", files)
+	}
+}
+
+func TestSpoolKeepsNotAcknowledgedMetrics(t *testing.T) {
+	spool, err := OpenSpool(SpoolConfig{Directory: t.TempDir()}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolMetrics(t, spool, 0, 4)
+	if peeked := spool.Peek(3); len(peeked) != 3 {
+		t.Fatalf("Peek returned %d metrics, want 3", len(peeked))
+	}
+	// only the first metric was queued
+	spool.Ack(1)
+	peeked := spool.Peek(10)
+	if len(peeked) != 3 || string(peeked[0]) != "m1:1|c" {
+		t.Fatalf("Peek after partial Ack returned %q", peeked)
+	}
+	if spool.Replayed.Load() != 1 {
+		t.Fatalf("Replayed = %d, want 1", spool.Replayed.Load())
+	}
+}
+
+func TestSpoolResumesReplayAfterRestart(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := OpenSpool(SpoolConfig{Directory: directory}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolMetrics(t, spool, 0, 5)
+	spool.Peek(2)
+	spool.Ack(2)
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenSpool(SpoolConfig{Directory: directory}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drainSpool(reopened, 10)
+	want := []string{"m2:1|c", "m3:1|c", "m4:1|c"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("replayed %v after restart, want %v", got, want)
+	}
+}
+
+func TestSpoolSkipsTruncatedRecord(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := OpenSpool(SpoolConfig{Directory: directory}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolMetrics(t, spool, 0, 2)
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a record whose header promises more bytes than were written before a crash
+	files := segmentFiles(t, directory)
+	file, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 100, 'x'})
+	file.Close()
+
+	reopened, err := OpenSpool(SpoolConfig{Directory: directory}, "localhost:8125:8126", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drainSpool(reopened, 10); len(got) != 2 {
+		t.Fatalf("replayed %v, want 2 complete records", got)
+	}
+	if !reopened.Empty() {
+		t.Fatalf("spool with a truncated record is not emptied")
+	}
+}
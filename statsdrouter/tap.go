@@ -0,0 +1,176 @@
+// Live view of metrics passing through the router
+package statsdrouter
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hard limits of taps, they protect the data path from slow or greedy subscribers
+const (
+	// Max number of simultaneous taps
+	TapMaxSubscribers = 10
+	// Max number of events per second a single tap receives
+	TapMaxEventsPerSecond = 100
+	// Size of tap's event buffer, events are dropped when it is full
+	tapBufferSize = 64
+)
+
+// Routing decision for one backend as shown by a tap
+type TapRoute struct {
+	Rule    string `json:"rule,omitempty"`
+	Backend string `json:"backend"`
+	Master  bool   `json:"master,omitempty"`
+	Send    bool   `json:"send"`
+	Reason  string `json:"reason"`
+}
+
+// Metric seen by a tap together with its routing decision
+type TapEvent struct {
+	Time   int64      `json:"time"`
+	Source string     `json:"source,omitempty"`
+	Metric string     `json:"metric"`
+	Name   string     `json:"name"`
+	Routes []TapRoute `json:"routes"`
+}
+
+// Filter of a tap, empty fields match everything
+type TapFilter struct {
+	// Metric name regexp
+	Name *regexp.Regexp
+	// Source IP address or ip:port
+	Source string
+	// Backend key (host:port:mgmt_port) among the routing decisions
+	Backend string
+	// Fraction of matching metrics to show, from 0 to 1
+	SampleRate float64
+	// Max events per second, capped by TapMaxEventsPerSecond
+	MaxEventsPerSecond int64
+}
+
+// Single tap subscription
+type Tap struct {
+	Events  chan *TapEvent
+	Dropped atomic.Uint64
+	filter  TapFilter
+	// fixed one second window rate limiter
+	window atomic.Int64
+	count  atomic.Int64
+}
+
+// Set of active taps
+type Taps struct {
+	active atomic.Int32
+	lock   sync.RWMutex
+	taps   map[*Tap]bool
+}
+
+// Creates a new Taps struct
+func NewTaps() *Taps {
+	return &Taps{taps: make(map[*Tap]bool)}
+}
+
+// Checks if there is at least one tap
+// it is cheap and is called for every metric
+func (taps *Taps) Active() bool {
+	return taps.active.Load() > 0
+}
+
+// Adds a new tap with the filter
+// returns the *Tap and an error if there are too many taps
+func (taps *Taps) Subscribe(filter TapFilter) (*Tap, error) {
+	if filter.MaxEventsPerSecond <= 0 || filter.MaxEventsPerSecond > TapMaxEventsPerSecond {
+		filter.MaxEventsPerSecond = TapMaxEventsPerSecond
+	}
+	if filter.SampleRate <= 0 || filter.SampleRate > 1 {
+		filter.SampleRate = 1
+	}
+	taps.lock.Lock()
+	defer taps.lock.Unlock()
+	if len(taps.taps) >= TapMaxSubscribers {
+		return nil, fmt.Errorf("too many taps, max is %d", TapMaxSubscribers)
+	}
+	tap := &Tap{Events: make(chan *TapEvent, tapBufferSize), filter: filter}
+	taps.taps[tap] = true
+	taps.active.Store(int32(len(taps.taps)))
+	return tap, nil
+}
+
+// Removes the tap
+func (taps *Taps) Unsubscribe(tap *Tap) {
+	taps.lock.Lock()
+	defer taps.lock.Unlock()
+	delete(taps.taps, tap)
+	taps.active.Store(int32(len(taps.taps)))
+}
+
+// Offers the metric and its routing decision to all taps
+// never blocks: events over the rate limit or buffer size are dropped
+func (taps *Taps) Publish(metric *StatsDMetric, routes []TapRoute) {
+	now := time.Now()
+	var event *TapEvent
+	taps.lock.RLock()
+	defer taps.lock.RUnlock()
+	for tap := range taps.taps {
+		if !tap.matches(metric, routes) || !tap.allow(now.Unix()) {
+			continue
+		}
+		if event == nil {
+			event = &TapEvent{Time: now.UnixNano(), Metric: string(metric.Raw()), Name: metric.name, Routes: routes}
+			if metric.source != nil {
+				event.Source = metric.source.String()
+			}
+		}
+		select {
+		case tap.Events <- event:
+		default:
+			tap.Dropped.Add(1)
+		}
+	}
+}
+
+// Checks if the metric passes tap's filter and sampling
+func (tap *Tap) matches(metric *StatsDMetric, routes []TapRoute) bool {
+	filter := tap.filter
+	if filter.Name != nil && !filter.Name.MatchString(metric.name) {
+		return false
+	}
+	if filter.Source != "" {
+		if metric.source == nil {
+			return false
+		}
+		if filter.Source != metric.source.IP.String() && filter.Source != metric.source.String() {
+			return false
+		}
+	}
+	if filter.Backend != "" {
+		found := false
+		for _, route := range routes {
+			if route.Backend == filter.Backend {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return filter.SampleRate >= 1 || rand.Float64() < filter.SampleRate
+}
+
+// Checks tap's rate limit for the current second
+func (tap *Tap) allow(second int64) bool {
+	if tap.window.Load() != second {
+		tap.window.Store(second)
+		tap.count.Store(0)
+	}
+	if tap.count.Add(1) > tap.filter.MaxEventsPerSecond {
+		tap.Dropped.Add(1)
+		return false
+	}
+	return true
+}